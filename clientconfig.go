@@ -0,0 +1,244 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// insteadOfRule is a url.<base>.insteadOf section of a git configuration,
+// rewriting the URLs of a repository to its mirror
+type insteadOfRule struct {
+	base      string
+	insteadOf []string
+}
+
+// runClientConfig implements the client-config command, which prints or
+// writes the git configuration that redirects clones of the mirrored
+// repositories to their mirrors
+func runClientConfig(args []string) {
+	flags := flag.NewFlagSet("client-config", flag.ExitOnError)
+	common := addRegistryFlags(flags)
+	common.addMirrorsFlag(flags)
+	filter := addFilterFlags(flags)
+	var serveURL = flags.String("serve-url", "", "Base URL of a serve command to point to, like http://mirror.example:8080 (default: the mirrors directory)")
+	var file = flags.String("file", "", "Write the configuration to this file instead of printing it")
+	var include = flags.Bool("include", false, "Include -file from the global git configuration")
+	var includeIf = flags.String("include-if", "", "Include -file from the global git configuration under this includeIf condition, like gitdir:~/work/")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s client-config [flags] [provider:owner/name ...]\n\n", AppName)
+		fmt.Fprintln(flags.Output(), "Prints the url.<base>.insteadOf rules that make git use the mirrors in place of the original URLs.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		exitf(exitConfigError, "Failed to parse arguments: %v", err)
+	}
+	if (*include || *includeIf != "") && *file == "" {
+		exitf(exitConfigError, "Failed to parse arguments: -include and -include-if need -file")
+	}
+
+	for _, selector := range flags.Args() {
+		if err := filter.addMatch(selector); err != nil {
+			exitf(exitConfigError, "Failed to parse arguments: %v", err)
+		}
+	}
+
+	registryFile, mirrorsDir := common.load()
+	repos, err := readRegistry(registryFile)
+	if err != nil {
+		exitf(exitRegistryError, "Failed to read registry: %v", err)
+	}
+	// Every repository of the registry decides which rules are safe, even
+	// the ones that are not selected or mirrored
+	registry := repos
+	repos = filter.apply(repos)
+
+	// Local rules only make sense for the mirrors that exist, while the
+	// mirrors of a serve URL may well be on another machine
+	if *serveURL == "" {
+		if mirrorsDir, err = filepath.Abs(mirrorsDir); err != nil {
+			exitf(exitConfigError, "Failed to resolve the mirrors directory: %v", err)
+		}
+		var mirrored []Repository
+		for _, repo := range repos {
+			if mirrorExists(repositoryDir(mirrorsDir, repo)) {
+				mirrored = append(mirrored, repo)
+			}
+		}
+		if skipped := len(repos) - len(mirrored); skipped > 0 {
+			log.Printf("Skipping %d repositories that are not mirrored yet", skipped)
+		}
+		repos = mirrored
+	}
+
+	rules := clientRules(mirrorsDir, *serveURL, repos, registry)
+	config := formatClientConfig(rules)
+	if *file == "" {
+		fmt.Print(config)
+		return
+	}
+
+	path := expandPath(*file)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		exitf(exitConfigError, "Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		exitf(exitConfigError, "Failed to write configuration: %v", err)
+	}
+	fmt.Printf("Wrote %d rules to %s\n", len(rules), path)
+
+	if *include {
+		if err := includeGitConfig("include.path", path); err != nil {
+			exitf(exitConfigError, "Failed to include configuration: %v", err)
+		}
+	}
+	if *includeIf != "" {
+		if err := includeGitConfig("includeIf."+*includeIf+".path", path); err != nil {
+			exitf(exitConfigError, "Failed to include configuration: %v", err)
+		}
+	}
+}
+
+// clientRules returns a rule per repository pointing to its mirror: the
+// mirror directory, or its path under serveURL when set. The URLs of the
+// registry repositories keep the rules from catching one another.
+func clientRules(mirrorsDir, serveURL string, repos, registry []Repository) []insteadOfRule {
+	var known []string
+	for _, repo := range registry {
+		known = append(known, bareCloneURLs(repo)...)
+	}
+	sort.Strings(known)
+
+	var rules []insteadOfRule
+	for _, repo := range repos {
+		repoDir := repositoryDir(mirrorsDir, repo)
+		base := filepath.ToSlash(repoDir)
+		if serveURL != "" {
+			rel, err := filepath.Rel(mirrorsDir, repoDir)
+			if err != nil {
+				continue
+			}
+			base = strings.TrimSuffix(serveURL, "/") + "/" + filepath.ToSlash(rel) + ".git"
+		}
+		rules = append(rules, insteadOfRule{base: base, insteadOf: repositoryURLs(repo, known)})
+	}
+	return rules
+}
+
+// repositoryURLs returns the insteadOf values of a repository: each URL it
+// may be cloned from, with and without .git. Git matches insteadOf values as
+// prefixes, so the URL without .git of github.com/golang/go would also
+// rewrite github.com/golang/go-cmp. When a known URL starts with it, the
+// URL ends with a slash instead.
+func repositoryURLs(repo Repository, known []string) []string {
+	var values []string
+	for _, bare := range bareCloneURLs(repo) {
+		values = append(values, bare+".git")
+		if hasLongerURL(known, bare) {
+			values = append(values, bare+"/")
+		} else {
+			values = append(values, bare)
+		}
+	}
+	return values
+}
+
+// bareCloneURLs returns the URLs a repository may be cloned from, without
+// .git: its own without credentials, the HTTPS and SSH URLs of its provider,
+// and the ssh:// form of scp-like URLs
+func bareCloneURLs(repo Repository) []string {
+	urls := []string{publicURL(repo.URL)}
+	if p, ok := providers[repo.Provider]; ok && p.URL == "" {
+		for _, protocol := range []string{"https", "ssh"} {
+			p.Protocol = protocol
+			urls = append(urls, p.cloneURL(repo.Owner, repo.Name))
+		}
+	}
+
+	var bare []string
+	seen := make(map[string]bool)
+	add := func(url string) {
+		url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+		if url != "" && !seen[url] {
+			seen[url] = true
+			bare = append(bare, url)
+		}
+	}
+	for _, url := range urls {
+		add(url)
+		if isCloneURL(url) && !strings.Contains(url, "://") {
+			// git@github.com:golang/go.git is ssh://git@github.com/golang/go.git
+			host, path, _ := strings.Cut(url, ":")
+			add("ssh://" + host + "/" + path)
+		}
+	}
+	return bare
+}
+
+// publicURL removes the credentials of a registry URL, which the rules would
+// publish while nobody clones with them: the user name and password of HTTP
+// URLs, and the password of the others. SSH user names like git@ are kept.
+func publicURL(rawURL string) string {
+	scheme, userinfo, hostPath, ok := cutUserinfo(rawURL)
+	if !ok {
+		return rawURL
+	}
+	if scheme == "http" || scheme == "https" {
+		return scheme + "://" + hostPath
+	}
+	user, _, _ := strings.Cut(userinfo, ":")
+	return scheme + "://" + user + "@" + hostPath
+}
+
+// hasLongerURL reports whether a URL of the sorted known URLs starts with,
+// but differs from, url
+func hasLongerURL(known []string, url string) bool {
+	for i := sort.SearchStrings(known, url); i < len(known) && strings.HasPrefix(known[i], url); i++ {
+		if known[i] != url {
+			return true
+		}
+	}
+	return false
+}
+
+// formatClientConfig renders rules as a gitconfig snippet
+func formatClientConfig(rules []insteadOfRule) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by %s client-config, run it again to update\n", AppName)
+	for _, rule := range rules {
+		fmt.Fprintf(&b, "[url %s]\n", quoteGitConfig(rule.base))
+		for _, url := range rule.insteadOf {
+			fmt.Fprintf(&b, "\tinsteadOf = %s\n", quoteGitConfig(url))
+		}
+	}
+	return b.String()
+}
+
+// quoteGitConfig quotes a subsection name or value of a gitconfig file
+func quoteGitConfig(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// includeGitConfig adds path to a multi-valued include key of the global git
+// configuration, unless it is already there
+func includeGitConfig(key, path string) error {
+	output, err := exec.Command("git", "config", "--global", "--get-all", key).Output()
+	if err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			if expandPath(line) == path {
+				return nil
+			}
+		}
+	}
+
+	if stderr, err := runCommand(exec.Command("git", "config", "--global", "--add", key, path)); err != nil {
+		return fmt.Errorf("%v: %s", err, lastLine(stderr))
+	}
+	fmt.Printf("Added %s = %s to the global git configuration\n", key, path)
+	return nil
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// commandFlags holds the path flags shared by the commands that work on the
+// registry and the mirrors
+type commandFlags struct {
+	registryFile *string
+	mirrorsDir   *string
+	configFile   *string
+}
+
+// addRegistryFlags defines the -input and -config flags on flags
+func addRegistryFlags(flags *flag.FlagSet) *commandFlags {
+	return &commandFlags{
+		registryFile: flags.String("input", DefaultRegistryFile, "Path to the registry file or directory"),
+		configFile:   flags.String("config", DefaultConfigFile, "Path to the configuration file"),
+	}
+}
+
+// addMirrorsFlag defines the -output flag, for commands that use the mirrors
+func (c *commandFlags) addMirrorsFlag(flags *flag.FlagSet) {
+	c.mirrorsDir = flags.String("output", DefaultMirrorsDir, "Directory to store mirrors")
+}
+
+// load loads the configuration file and returns the registry and mirrors
+// paths with environment variables and tilde (~) expanded
+func (c *commandFlags) load() (registryFile, mirrorsDir string) {
+	loadConfigFile(*c.configFile)
+
+	registryFile = expandPath(*c.registryFile)
+	if c.mirrorsDir != nil {
+		mirrorsDir = expandPath(*c.mirrorsDir)
+	}
+	return registryFile, mirrorsDir
+}
+
+// runAdd implements the add command, which appends a repository to the
+// registry file
+func runAdd(args []string) {
+	flags := flag.NewFlagSet("add", flag.ExitOnError)
+	common := addRegistryFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s add [flags] <spec>\n\n", AppName)
+		fmt.Fprintln(flags.Output(), "Appends a repository, in the short format or as a clone URL, to the registry file.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		exitf(exitConfigError, "Failed to parse arguments: %v", err)
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	registryFile, _ := common.load()
+	repo, err := addRepository(registryFile, flags.Arg(0))
+	if err != nil {
+		exitf(exitRegistryError, "Failed to add repository: %v", err)
+	}
+
+	fmt.Printf("Added %s to %s\n", flags.Arg(0), registryFile)
+	if repo.Name == "" {
+		fmt.Println("Mirror directories: one per repository of the pattern, found at sync time")
+		return
+	}
+	fmt.Printf("Mirror directory: %s\n", filepath.ToSlash(repositoryDir("", repo)))
+}
+
+// runRemove implements the remove command, which removes a repository from
+// the registry file and optionally deletes its mirror
+func runRemove(args []string) {
+	flags := flag.NewFlagSet("remove", flag.ExitOnError)
+	common := addRegistryFlags(flags)
+	common.addMirrorsFlag(flags)
+	purge := flags.Bool("purge", false, "Also delete the mirror directory")
+	lockTimeout := flags.Duration("lock-timeout", 0, "With -purge, how long to wait for a sync or gc of the mirror to finish (0 to exit at once)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s remove [flags] <spec>\n\n", AppName)
+		fmt.Fprintln(flags.Output(), "Removes the entries of a repository from the registry file.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		exitf(exitConfigError, "Failed to parse arguments: %v", err)
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	registryFile, mirrorsDir := common.load()
+
+	// A running sync could clone the mirror again right after it is deleted,
+	// so purging waits for it to finish before touching the registry
+	if *purge {
+		lock, err := lockMirrorsDir(mirrorsDir, *lockTimeout, "remove")
+		if errors.Is(err, errLocked) {
+			exitf(exitLocked, "Another run is in progress: %v", err)
+		} else if err != nil {
+			exitf(exitConfigError, "Failed to lock mirrors directory: %v", err)
+		}
+		defer lock.release()
+	}
+
+	removed, err := removeRepository(registryFile, flags.Arg(0))
+	if err != nil {
+		exitf(exitRegistryError, "Failed to remove repository: %v", err)
+	}
+	for _, entry := range removed {
+		fmt.Printf("- %s\n", entry.Repo)
+	}
+	fmt.Printf("Removed %d entries from %s\n", len(removed), registryFile)
+
+	if !*purge {
+		return
+	}
+	for _, entry := range removed {
+		repo, err := entry.repository()
+		if err != nil {
+			continue // Patterns and exclusions have no mirror of their own
+		}
+		dir := repositoryDir(mirrorsDir, repo)
+		switch err := purgeMirror(context.Background(), mirrorsDir, repo, *lockTimeout); {
+		case err == nil:
+			fmt.Printf("Deleted %s\n", dir)
+		case errors.Is(err, fs.ErrNotExist):
+			fmt.Printf("No mirror at %s\n", dir)
+		case errors.Is(err, errLocked):
+			exitf(exitLocked, "Failed to delete mirror: %v", err)
+		default:
+			exitf(exitConfigError, "Failed to delete mirror: %v", err)
+		}
+	}
+}
+
+// runList implements the list command, which prints the repositories of the
+// registry as they will be mirrored
+func runList(args []string) {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	common := addRegistryFlags(flags)
+	filter := addFilterFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s list [flags] [provider:owner/name ...]\n\n", AppName)
+		fmt.Fprintln(flags.Output(), "Lists the repositories of the registry with their URL and mirror directory.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		exitf(exitConfigError, "Failed to parse arguments: %v", err)
+	}
+
+	for _, selector := range flags.Args() {
+		if err := filter.addMatch(selector); err != nil {
+			exitf(exitConfigError, "Failed to parse arguments: %v", err)
+		}
+	}
+
+	registryFile, _ := common.load()
+	repos, err := readRegistry(registryFile)
+	if err != nil {
+		exitf(exitRegistryError, "Failed to read registry: %v", err)
+	}
+	repos = filter.apply(repos)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tURL\tPATH\tLABELS")
+	for _, repo := range repos {
+		var labels []string
+		if repo.Options != nil {
+			labels = repo.Options.Labels
+		}
+		fmt.Fprintf(w, "%s:%s/%s\t%s\t%s\t%s\n", repo.Provider, repo.Owner, repo.Name, redactURL(repo.URL),
+			filepath.ToSlash(repositoryDir("", repo)), strings.Join(labels, ","))
+	}
+	if err := w.Flush(); err != nil {
+		exitf(exitConfigError, "Failed to write list: %v", err)
+	}
+}
+
+// runStatus implements the status command, which compares the mirrors on
+// disk with the registry
+func runStatus(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	common := addRegistryFlags(flags)
+	common.addMirrorsFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s status [flags]\n\n", AppName)
+		fmt.Fprintln(flags.Output(), "Reports the mirrored, missing and untracked repositories.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		exitf(exitConfigError, "Failed to parse arguments: %v", err)
+	}
+
+	registryFile, mirrorsDir := common.load()
+	repos, err := readRegistry(registryFile)
+	if err != nil {
+		exitf(exitRegistryError, "Failed to read registry: %v", err)
+	}
+	states, err := mirrorStatus(mirrorsDir, repos)
+	if err != nil {
+		exitf(exitConfigError, "Failed to read mirrors: %v", err)
+	}
+
+	counts := make(map[string]int)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATE\tPATH\tLAST SYNC")
+	for _, state := range states {
+		counts[state.State]++
+		lastSync := "-"
+		if !state.LastSync.IsZero() {
+			lastSync = fmt.Sprintf("%s ago", time.Since(state.LastSync).Round(time.Second))
+		} else if state.State == stateMirrored {
+			lastSync = "unknown"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", state.State, state.Path, lastSync)
+	}
+	if err := w.Flush(); err != nil {
+		exitf(exitConfigError, "Failed to write status: %v", err)
+	}
+
+	fmt.Printf("\n%d mirrored, %d missing, %d untracked\n",
+		counts[stateMirrored], counts[stateMissing], counts[stateUntracked])
+}
+
+// addRepository validates spec and appends it to the registry file, unless
+// a repository with the same mirror directory is already listed there. An
+// owner pattern is appended unless listed as is, and returns no repository:
+// the repositories it expands into are only known at sync time.
+func addRepository(registryFile, spec string) (Repository, error) {
+	spec = strings.TrimSpace(spec)
+	pattern := isOwnerPattern(spec)
+	var repo Repository
+	var err error
+	if pattern {
+		err = validateOwnerPattern(spec)
+	} else {
+		repo, err = parseRepositoryLine(spec)
+	}
+	if err != nil {
+		return Repository{}, fmt.Errorf("invalid entry '%s': %v", spec, err)
+	}
+
+	if info, err := os.Stat(registryFile); err == nil && info.IsDir() {
+		return Repository{}, fmt.Errorf("%s is a directory, choose one of its files with -input", registryFile)
+	}
+	entries, err := readRegistryEntries(registryFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Repository{}, err
+	}
+
+	for _, entry := range entries {
+		listed := strings.TrimSpace(entry.Repo) == spec
+		if !pattern {
+			if listedRepo, err := entry.repository(); err == nil && mirrorKey(listedRepo) == mirrorKey(repo) {
+				listed = true
+			}
+		}
+		if listed {
+			return Repository{}, fmt.Errorf("%s is already listed at %s:%d", spec, registryFile, entry.Line)
+		}
+	}
+
+	return repo, appendRegistryEntries(registryFile, entries, []string{spec}, "")
+}
+
+// removeRepository removes the entries of the registry file that are spec
+// itself or share its mirror directory, and returns them. Plain-text
+// registries keep their other lines, comments included, as they are.
+func removeRepository(registryFile, spec string) ([]registryEntry, error) {
+	spec = strings.TrimSpace(spec)
+	key := ""
+	if repo, err := parseRepositoryLine(spec); err == nil {
+		key = mirrorKey(repo)
+	}
+
+	entries, err := readRegistryEntries(registryFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept, removed []registryEntry
+	for _, entry := range entries {
+		matched := entry.Include == "" && strings.TrimSpace(entry.Repo) == spec
+		if listed, err := entry.repository(); err == nil && key != "" && mirrorKey(listed) == key {
+			matched = true
+		}
+		if matched {
+			removed = append(removed, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, fmt.Errorf("%s is not listed in %s", spec, registryFile)
+	}
+
+	if isStructuredRegistry(registryFile) {
+		return removed, writeRegistryEntries(registryFile, kept)
+	}
+
+	content, err := os.ReadFile(registryFile)
+	if err != nil {
+		return nil, err
+	}
+	dropped := make(map[int]bool)
+	for _, entry := range removed {
+		dropped[entry.Line] = true
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	var b strings.Builder
+	for i, line := range lines {
+		if !dropped[i+1] {
+			b.WriteString(line)
+		}
+	}
+	if err := os.WriteFile(registryFile, []byte(b.String()), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write %s: %v", registryFile, err)
+	}
+	return removed, nil
+}
+
+// purgeMirror deletes the mirror of repo, along with the parent directories
+// left empty up to the mirrors directory. Directories that do not hold a
+// mirror are left alone. It holds the lock of the mirror meanwhile, waiting
+// up to lockTimeout for a sync, gc or serve request to release it.
+func purgeMirror(ctx context.Context, mirrorsDir string, repo Repository, lockTimeout time.Duration) error {
+	dir := repositoryDir(mirrorsDir, repo)
+	lockCtx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+	lock, err := lockRepository(lockCtx, mirrorsDir, repo, true, "remove")
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	// A sync may have cloned the mirror, or a failed clone left no mirror,
+	// while waiting for the lock
+	if !mirrorExists(dir) {
+		return fmt.Errorf("no mirror at %s: %w", dir, fs.ErrNotExist)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	root := filepath.Clean(mirrorsDir)
+	for parent := filepath.Dir(dir); parent != root && strings.HasPrefix(parent, root); parent = filepath.Dir(parent) {
+		if os.Remove(parent) != nil {
+			break // Not empty
+		}
+	}
+	return nil
+}
+
+// Mirror states reported by the status command
+const (
+	stateMirrored  = "mirrored"
+	stateMissing   = "missing"
+	stateUntracked = "untracked"
+)
+
+// mirrorState is the state of a mirror directory relative to the registry
+type mirrorState struct {
+	State    string
+	Path     string
+	LastSync time.Time
+}
+
+// mirrorStatus reports every registry repository as mirrored or missing,
+// followed by the mirrors found under mirrorsDir that are not in the
+// registry. Paths are relative to mirrorsDir.
+func mirrorStatus(mirrorsDir string, repos []Repository) ([]mirrorState, error) {
+	var states []mirrorState
+	tracked := make(map[string]bool)
+	for _, repo := range repos {
+		dir := repositoryDir(mirrorsDir, repo)
+		tracked[dir] = true
+
+		state := mirrorState{State: stateMissing, Path: filepath.ToSlash(repositoryDir("", repo))}
+		if mirrorExists(dir) {
+			state.State = stateMirrored
+			state.LastSync, _ = lastSyncTime(dir)
+		}
+		states = append(states, state)
+	}
+
+	err := filepath.WalkDir(mirrorsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == mirrorsDir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if !d.IsDir() || path == mirrorsDir {
+			return nil
+		}
+		if tracked[path] || strings.HasPrefix(d.Name(), ".") {
+			return fs.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, "HEAD")); err == nil && mirrorExists(path) {
+			rel, err := filepath.Rel(mirrorsDir, path)
+			if err != nil {
+				return err
+			}
+			states = append(states, mirrorState{State: stateUntracked, Path: filepath.ToSlash(rel)})
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return states, err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAddRepository(t *testing.T) {
+	tmpDir := t.TempDir()
+	textFile := filepath.Join(tmpDir, "registry.txt")
+	jsonFile := filepath.Join(tmpDir, "registry.json")
+	writeRegistryFiles(t, tmpDir, map[string]string{
+		"registry.txt":  "# Go\ngithub:golang/go",
+		"registry.json": `{"repositories": [{"repo": "github:golang/go", "lfs": true}]}`,
+	})
+
+	if _, err := addRepository(textFile, "gitlab:group/subgroup/project"); err != nil {
+		t.Fatalf("addRepository() unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(textFile)
+	if err != nil {
+		t.Fatalf("Failed to read registry: %v", err)
+	}
+	if expected := "# Go\ngithub:golang/go\ngitlab:group/subgroup/project\n"; string(content) != expected {
+		t.Errorf("registry = %q, want %q", content, expected)
+	}
+
+	if _, err := addRepository(jsonFile, "github:golang/tools"); err != nil {
+		t.Fatalf("addRepository() unexpected error: %v", err)
+	}
+	repos, err := readRegistry(jsonFile)
+	if err != nil {
+		t.Fatalf("readRegistry() unexpected error: %v", err)
+	}
+	if len(repos) != 2 || repos[0].Options == nil || !repos[0].Options.LFS {
+		t.Errorf("readRegistry() after add = %+v, want the existing options kept", repos)
+	}
+
+	// A pattern is listed as is, without a mirror of its own
+	if repo, err := addRepository(textFile, "github:kubernetes/*"); err != nil || repo.Name != "" {
+		t.Fatalf("addRepository() of a pattern = %+v, %v, want no repository", repo, err)
+	}
+
+	for _, spec := range []string{"https://github.com/Golang/Go.git", "codeberg:someone/repo", "github:nopath", "github:kubernetes/*", "codeberg:someone/*", "github:x/[a"} {
+		if _, err := addRepository(textFile, spec); err == nil {
+			t.Errorf("addRepository(%q) expected error but got none", spec)
+		}
+	}
+	if _, err := addRepository(tmpDir, "github:golang/tools"); err == nil {
+		t.Error("addRepository() on a directory expected error but got none")
+	}
+}
+
+func TestRemoveRepository(t *testing.T) {
+	tmpDir := t.TempDir()
+	textFile := filepath.Join(tmpDir, "registry.txt")
+	jsonFile := filepath.Join(tmpDir, "registry.json")
+	writeRegistryFiles(t, tmpDir, map[string]string{
+		"registry.txt":  "# Go\ngithub:golang/go\nhttps://github.com/golang/go.git\n\n# Kubernetes\ngithub:kubernetes/*\ngithub:golang/tools\n",
+		"registry.json": `{"repositories": [{"repo": "github:golang/go"}, {"repo": "github:golang/tools"}]}`,
+	})
+
+	removed, err := removeRepository(textFile, "github:Golang/Go")
+	if err != nil {
+		t.Fatalf("removeRepository() unexpected error: %v", err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("removeRepository() removed %d entries, want 2", len(removed))
+	}
+	if _, err := removeRepository(textFile, "github:kubernetes/*"); err != nil {
+		t.Fatalf("removeRepository() of a pattern unexpected error: %v", err)
+	}
+	content, err := os.ReadFile(textFile)
+	if err != nil {
+		t.Fatalf("Failed to read registry: %v", err)
+	}
+	if expected := "# Go\n\n# Kubernetes\ngithub:golang/tools\n"; string(content) != expected {
+		t.Errorf("registry = %q, want %q", content, expected)
+	}
+
+	if _, err := removeRepository(jsonFile, "github:golang/tools"); err != nil {
+		t.Fatalf("removeRepository() unexpected error: %v", err)
+	}
+	entries, err := readRegistryEntries(jsonFile)
+	if err != nil {
+		t.Fatalf("readRegistryEntries() unexpected error: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Repo != "github:golang/go" {
+		t.Errorf("registry entries = %+v, want only github:golang/go", entries)
+	}
+
+	if _, err := removeRepository(textFile, "github:golang/go"); err == nil {
+		t.Error("removeRepository() of a missing entry expected error but got none")
+	}
+}
+
+func TestPurgeMirror(t *testing.T) {
+	source := createSourceRepository(t)
+	mirrorsDir := t.TempDir()
+	repo := Repository{Provider: "local", Owner: "group/subgroup", Name: "source", URL: source}
+	runGit(t, mirrorsDir, "clone", "--quiet", "--mirror", source, repositoryDir(mirrorsDir, repo))
+	sibling := Repository{Provider: "local", Owner: "group", Name: "other"}
+	if err := os.MkdirAll(repositoryDir(mirrorsDir, sibling), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	// A sync of the mirror keeps it from being deleted under it
+	lock, err := lockRepository(context.Background(), mirrorsDir, repo, true, "sync")
+	if err != nil {
+		t.Fatalf("lockRepository() unexpected error: %v", err)
+	}
+	if err := purgeMirror(context.Background(), mirrorsDir, repo, 0); !errors.Is(err, errLocked) {
+		t.Errorf("purgeMirror() of a locked mirror = %v, want errLocked", err)
+	}
+	if !mirrorExists(repositoryDir(mirrorsDir, repo)) {
+		t.Fatal("purgeMirror() deleted a locked mirror")
+	}
+	lock.release()
+
+	if err := purgeMirror(context.Background(), mirrorsDir, repo, 0); err != nil {
+		t.Fatalf("purgeMirror() unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mirrorsDir, "local", "group", "subgroup")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("empty parent directory should be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mirrorsDir, "local", "group")); err != nil {
+		t.Errorf("non-empty parent directory should be kept, got %v", err)
+	}
+
+	// Directories that are not mirrors are never deleted
+	if err := purgeMirror(context.Background(), mirrorsDir, sibling, 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("purgeMirror() of a plain directory = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestMirrorStatus(t *testing.T) {
+	source := createSourceRepository(t)
+	mirrorsDir := t.TempDir()
+	mirrored := Repository{Provider: "local", Owner: "test", Name: "mirrored", URL: source}
+	missing := Repository{Provider: "local", Owner: "test", Name: "missing", URL: source}
+	runGit(t, mirrorsDir, "clone", "--quiet", "--mirror", source, repositoryDir(mirrorsDir, mirrored))
+	runGit(t, mirrorsDir, "clone", "--quiet", "--mirror", source, filepath.Join(mirrorsDir, "local", "old", "untracked"))
+	writeRegistryFiles(t, mirrorsDir, map[string]string{"registry.txt": "local:test/mirrored\n"})
+
+	states, err := mirrorStatus(mirrorsDir, []Repository{mirrored, missing})
+	if err != nil {
+		t.Fatalf("mirrorStatus() unexpected error: %v", err)
+	}
+
+	var lines []string
+	for _, state := range states {
+		lines = append(lines, state.State+" "+state.Path)
+	}
+	expected := []string{"mirrored local/test/mirrored", "missing local/test/missing", "untracked local/old/untracked"}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("mirrorStatus() = %v, want %v", lines, expected)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDaemonPort is the port of the git daemon protocol
+const DefaultDaemonPort = 9418
+
+// daemonRequestTimeout is how long a git:// client has to send its request,
+// and daemonIdleTimeout how long a transfer may go without any data before
+// upload-pack gives up on it
+const (
+	daemonRequestTimeout = 30 * time.Second
+	daemonIdleTimeout    = 10 * time.Minute
+)
+
+// maxPktLine is the largest pkt-line of the git protocol
+const maxPktLine = 65520
+
+// serveDaemon answers git:// requests on listener until ctx is done, then
+// waits for the running transfers to end
+func (s *gitServer) serveDaemon(ctx context.Context, listener net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			if err := s.handleDaemonConn(ctx, conn); err != nil {
+				log.Printf("Warning: git://%s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// daemonRequest is the first pkt-line sent by a git:// client, like
+// "git-upload-pack /torvalds/linux.git\0host=mirror.example\0\0version=2\0"
+type daemonRequest struct {
+	service string
+	path    string
+	host    string
+	// params are the extra parameters, passed to upload-pack as GIT_PROTOCOL
+	params []string
+}
+
+func parseDaemonRequest(line string) (daemonRequest, error) {
+	fields := strings.Split(strings.TrimSuffix(line, "\x00"), "\x00")
+	command := strings.TrimSuffix(fields[0], "\n")
+	service, path, found := strings.Cut(command, " ")
+	if !found || path == "" {
+		return daemonRequest{}, fmt.Errorf("invalid request %q", command)
+	}
+
+	request := daemonRequest{service: service, path: path}
+	for _, field := range fields[1:] {
+		if host, found := strings.CutPrefix(field, "host="); found {
+			request.host = host
+		} else if field != "" && gitProtocolHeader.MatchString(field) {
+			request.params = append(request.params, field)
+		}
+	}
+	return request, nil
+}
+
+// handleDaemonConn serves the request of a git:// connection, running
+// upload-pack for the mirrors of the registry and answering anything else
+// with an error the client shows as "remote error"
+func (s *gitServer) handleDaemonConn(ctx context.Context, conn net.Conn) error {
+	_ = conn.SetReadDeadline(time.Now().Add(daemonRequestTimeout))
+	line, err := readPktLine(conn)
+	if err != nil {
+		return fmt.Errorf("Failed to read request: %w", err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	request, err := parseDaemonRequest(line)
+	if err != nil {
+		return daemonError(conn, "invalid request", err)
+	}
+	switch request.service {
+	case "git-upload-pack":
+	case "git-receive-pack":
+		return daemonError(conn, "pushing is not supported, mirrors are read-only", nil)
+	default:
+		return daemonError(conn, "service not enabled", fmt.Errorf("unsupported service %q", request.service))
+	}
+
+	repo, ok := s.resolve(request.host, request.path)
+	if !ok {
+		return daemonError(conn, "repository not exported", fmt.Errorf("%s not found in the registry", request.path))
+	}
+	lock, err := s.lock(ctx, repo)
+	if err != nil {
+		return daemonError(conn, "the mirror is being updated, try again later", err)
+	}
+	defer lock.release()
+
+	repoDir := repositoryDir(s.mirrorsDir, repo)
+	cmd := exec.CommandContext(ctx, "git", "upload-pack", "--strict",
+		"--timeout="+strconv.Itoa(int(daemonIdleTimeout.Seconds())), repoDir)
+	if len(request.params) > 0 {
+		cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+strings.Join(request.params, ":"))
+	}
+	// Copy the connection ourselves rather than through cmd.Stdin, which
+	// would keep Wait waiting for the client to close it
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	go func() {
+		_, _ = io.Copy(stdin, conn)
+		stdin.Close()
+	}()
+	cmd.Stdout = conn
+	if stderr, err := runCommand(cmd); err != nil {
+		return fmt.Errorf("upload-pack of %s failed: %v: %s", repoDir, err, lastLine(stderr))
+	}
+	return nil
+}
+
+// daemonError sends message to a git:// client and returns err for the log
+func daemonError(conn net.Conn, message string, err error) error {
+	_, _ = io.WriteString(conn, pktLine("ERR "+message+"\n"))
+	return err
+}
+
+// readPktLine reads a single pkt-line and returns its data
+func readPktLine(r io.Reader) (string, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", err
+	}
+	length, err := strconv.ParseUint(string(header[:]), 16, 16)
+	if err != nil || length < 4 || length > maxPktLine {
+		return "", fmt.Errorf("invalid pkt-line length %q", header[:])
+	}
+	data := make([]byte, length-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
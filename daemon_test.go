@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// serveDaemon serves the mirrors of serveMirrors over git:// on a local
+// listener until the test ends
+func serveDaemon(t *testing.T) string {
+	t.Helper()
+	server, _ := serveMirrors(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- server.serveDaemon(ctx, listener) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("serveDaemon() unexpected error: %v", err)
+		}
+	})
+	return "git://" + listener.Addr().String()
+}
+
+func TestDaemonClone(t *testing.T) {
+	url := serveDaemon(t)
+
+	for _, path := range []string{"/local/test/source.git", "/torvalds/linux.git", "/github/Torvalds/linux"} {
+		for _, protocol := range []string{"0", "2"} {
+			dir := t.TempDir()
+			runGit(t, dir, "-c", "protocol.version="+protocol, "clone", "--quiet", url+path, "clone")
+			if tag := runGit(t, filepath.Join(dir, "clone"), "tag"); tag != "v1.0.0" {
+				t.Errorf("tags cloned from %s with protocol v%s = %q, want v1.0.0", path, protocol, tag)
+			}
+		}
+	}
+}
+
+func TestDaemonRejects(t *testing.T) {
+	url := serveDaemon(t)
+
+	tests := map[string]string{
+		"/local/test/unlisted.git":       "repository not exported",
+		"/local/test/../test/source.git": "repository not exported",
+		"/.locks/local/test/source.lock": "repository not exported",
+		"/local/test/missing.git":        "repository not exported",
+	}
+	for path, expected := range tests {
+		output, err := gitOutput(t.TempDir(), "clone", "--quiet", url+path, "clone")
+		if err == nil || !strings.Contains(output, expected) {
+			t.Errorf("clone of %s = %v: %s, want %q", path, err, output, expected)
+		}
+	}
+
+	dir := t.TempDir()
+	runGit(t, dir, "clone", "--quiet", url+"/local/test/source.git", "clone")
+	output, err := gitOutput(filepath.Join(dir, "clone"), "push", "origin", "main:pushed")
+	if err == nil || !strings.Contains(output, "read-only") {
+		t.Errorf("push = %v: %s, want a read-only error", err, output)
+	}
+}
+
+func TestParseDaemonRequest(t *testing.T) {
+	request, err := parseDaemonRequest("git-upload-pack /torvalds/linux.git\x00host=mirror.example:9418\x00\x00version=2\x00")
+	expected := daemonRequest{service: "git-upload-pack", path: "/torvalds/linux.git", host: "mirror.example:9418", params: []string{"version=2"}}
+	if err != nil || !reflect.DeepEqual(request, expected) {
+		t.Errorf("parseDaemonRequest() = %+v, %v, want %+v", request, err, expected)
+	}
+
+	if _, err := parseDaemonRequest("git-upload-pack"); err == nil {
+		t.Errorf("parseDaemonRequest() without a path should fail")
+	}
+}
+
+// gitOutput runs a git command that may fail and returns its output
+func gitOutput(dir string, args ...string) (string, error) {
+	output, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	return string(output), err
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// apiClient is the HTTP client used to talk to the provider APIs
+var apiClient = &http.Client{Timeout: 30 * time.Second}
+
+// defaultAPIURLs holds the API URL templates of self-hosted providers that do
+// not set their own, by kind
+var defaultAPIURLs = map[string]string{
+	"github": "https://{host}/api/v3",
+	"gitlab": "https://{host}/api/v4",
+	"gitea":  "https://{host}/api/v1",
+}
+
+// linkNextPattern extracts the next page from an RFC 8288 Link header
+var linkNextPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// ownerPattern is a registry entry such as "github:kubernetes/*" that expands
+// into the repositories of an owner. Name is a glob matched against the
+// repository names, and "**" also descends into nested groups where the
+// provider has them.
+type ownerPattern struct {
+	Provider  string
+	Owner     string
+	Name      string
+	Recursive bool
+}
+
+// isOwnerPattern reports whether line is a short-form entry with a wildcard
+// in its repository name, like "github:kubernetes/*" or "gitlab:gitlab-org/**"
+func isOwnerPattern(line string) bool {
+	if isCloneURL(line) {
+		return false
+	}
+	return strings.ContainsAny(line, "*?[")
+}
+
+// parseOwnerPattern parses a short-form entry with a wildcard name
+func parseOwnerPattern(line string) (ownerPattern, error) {
+	provider, repoPath, found := strings.Cut(line, ":")
+	if !found || provider == "" {
+		return ownerPattern{}, fmt.Errorf("invalid format: expected 'provider:owner/pattern'")
+	}
+
+	slash := strings.LastIndex(repoPath, "/")
+	if slash <= 0 || slash == len(repoPath)-1 {
+		return ownerPattern{}, fmt.Errorf("invalid pattern: expected 'owner/pattern'")
+	}
+	owner, name := repoPath[:slash], repoPath[slash+1:]
+
+	if _, err := path.Match(name, ""); err != nil {
+		return ownerPattern{}, fmt.Errorf("invalid pattern %q: %v", name, err)
+	}
+
+	pattern := ownerPattern{Provider: provider, Owner: owner, Name: name}
+	if name == "**" {
+		pattern.Name = "*"
+		pattern.Recursive = true
+	}
+	return pattern, nil
+}
+
+// validateOwnerPattern checks an owner pattern entry without expanding it
+func validateOwnerPattern(line string) error {
+	pattern, err := parseOwnerPattern(line)
+	if err != nil {
+		return err
+	}
+	if _, ok := providers[pattern.Provider]; !ok {
+		return fmt.Errorf("unsupported provider: %s", pattern.Provider)
+	}
+	return nil
+}
+
+// matches reports whether repo is selected by the pattern, which is how
+// exclusion lines ("!github:kubernetes/website") are applied
+func (p ownerPattern) matches(repo Repository) bool {
+	if p.Provider != repo.Provider {
+		return false
+	}
+	if p.Recursive {
+		if repo.Owner != p.Owner && !strings.HasPrefix(repo.Owner, p.Owner+"/") {
+			return false
+		}
+	} else if ok, _ := path.Match(p.Owner, repo.Owner); !ok {
+		return false
+	}
+	ok, _ := path.Match(p.Name, repo.Name)
+	return ok
+}
+
+// expandOwnerPattern lists the repositories of the pattern's owner through
+// the provider API and returns those whose name matches
+func expandOwnerPattern(pattern ownerPattern) ([]Repository, error) {
+	provider, ok := providers[pattern.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unsupported provider: %s", pattern.Provider)
+	}
+	if strings.ContainsAny(pattern.Owner, "*?[") {
+		return nil, fmt.Errorf("the owner cannot be a pattern")
+	}
+
+	paths, err := listOwnerRepositories(provider, pattern.Owner, pattern.Recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	var repos []Repository
+	for _, repoPath := range paths {
+		repo, err := parseRepositoryLine(pattern.Provider + ":" + repoPath)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected repository %s: %v", repoPath, err)
+		}
+		if ok, _ := path.Match(pattern.Name, repo.Name); ok {
+			repos = append(repos, repo)
+		}
+	}
+
+	return repos, nil
+}
+
+// isExcluded reports whether repo is matched by any exclusion pattern
+func isExcluded(repo Repository, excludes []ownerPattern) bool {
+	for _, pattern := range excludes {
+		if pattern.matches(repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiURL returns the base URL of the provider API
+func (p Provider) apiURL() (string, error) {
+	if p.API != "" {
+		return strings.TrimSuffix(p.API, "/"), nil
+	}
+	template, ok := defaultAPIURLs[p.Kind]
+	if !ok || p.Host == "" {
+		return "", fmt.Errorf("listing repositories is not supported for %s providers", p.Kind)
+	}
+	return strings.ReplaceAll(template, "{host}", p.Host), nil
+}
+
+// listOwnerRepositories returns the "owner/name" paths of every repository of
+// a user or organization, following pagination
+func listOwnerRepositories(provider Provider, owner string, recursive bool) ([]string, error) {
+	api, err := provider.apiURL()
+	if err != nil {
+		return nil, err
+	}
+
+	switch provider.Kind {
+	case "github":
+		var paths []string
+		err := fetchPages(provider, api+"/users/"+url.PathEscape(owner)+"/repos?per_page=100&type=owner",
+			func(data []byte) (string, error) {
+				var page []struct {
+					FullName string `json:"full_name"`
+				}
+				err := json.Unmarshal(data, &page)
+				for _, r := range page {
+					paths = append(paths, r.FullName)
+				}
+				return "", err
+			})
+		return paths, err
+
+	case "gitea":
+		var paths []string
+		decode := func(data []byte) (string, error) {
+			var page []struct {
+				FullName string `json:"full_name"`
+			}
+			err := json.Unmarshal(data, &page)
+			for _, r := range page {
+				paths = append(paths, r.FullName)
+			}
+			return "", err
+		}
+		// Organizations and users have separate endpoints
+		err := fetchPages(provider, api+"/orgs/"+url.PathEscape(owner)+"/repos?limit=50", decode)
+		if isNotFound(err) {
+			err = fetchPages(provider, api+"/users/"+url.PathEscape(owner)+"/repos?limit=50", decode)
+		}
+		return paths, err
+
+	case "gitlab":
+		var paths []string
+		decode := func(data []byte) (string, error) {
+			var page []struct {
+				PathWithNamespace string `json:"path_with_namespace"`
+			}
+			err := json.Unmarshal(data, &page)
+			for _, r := range page {
+				paths = append(paths, r.PathWithNamespace)
+			}
+			return "", err
+		}
+		// Groups and users have separate endpoints, and only groups nest
+		groupURL := fmt.Sprintf("%s/groups/%s/projects?per_page=100&include_subgroups=%t",
+			api, url.PathEscape(owner), recursive)
+		err := fetchPages(provider, groupURL, decode)
+		if isNotFound(err) {
+			err = fetchPages(provider, api+"/users/"+url.PathEscape(owner)+"/projects?per_page=100", decode)
+		}
+		return paths, err
+
+	case "bitbucket":
+		var paths []string
+		err := fetchPages(provider, api+"/repositories/"+url.PathEscape(owner)+"?pagelen=100",
+			func(data []byte) (string, error) {
+				var page struct {
+					Values []struct {
+						FullName string `json:"full_name"`
+					} `json:"values"`
+					Next string `json:"next"`
+				}
+				err := json.Unmarshal(data, &page)
+				for _, r := range page.Values {
+					paths = append(paths, r.FullName)
+				}
+				return page.Next, err
+			})
+		return paths, err
+	}
+
+	return nil, fmt.Errorf("listing repositories is not supported for %s providers", provider.Kind)
+}
+
+// apiError is returned for API responses with an unexpected status
+type apiError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d", e.URL, e.StatusCode)
+}
+
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*apiError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// fetchPages requests rawURL and every following page. decode receives each
+// response body and may return the next page URL when the provider puts it
+// in the body; otherwise the Link header is followed.
+func fetchPages(provider Provider, rawURL string, decode func([]byte) (string, error)) error {
+	for rawURL != "" {
+		req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("User-Agent", AppName+"/"+AppVersion)
+		if provider.TokenEnv != "" {
+			if token := os.Getenv(provider.TokenEnv); token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+
+		resp, err := apiClient.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return &apiError{URL: rawURL, StatusCode: resp.StatusCode}
+		}
+
+		next, err := decode(data)
+		if err != nil {
+			return fmt.Errorf("%s: invalid response: %v", rawURL, err)
+		}
+		if next == "" {
+			if match := linkNextPattern.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+				next = match[1]
+			}
+		}
+		rawURL = next
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// newProviderAPI starts a local stand-in of the GitHub, GitLab, Gitea and
+// Bitbucket listing APIs, serving pages of two repositories
+func newProviderAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	pages := func(w http.ResponseWriter, r *http.Request, items []map[string]string) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page == 0 {
+			page = 1
+		}
+		start, end := (page-1)*2, page*2
+		if end < len(items) {
+			next := *r.URL
+			query := next.Query()
+			query.Set("page", strconv.Itoa(page+1))
+			next.RawQuery = query.Encode()
+			w.Header().Set("Link", fmt.Sprintf(`<http://%s%s>; rel="next"`, r.Host, next.String()))
+		} else {
+			end = len(items)
+		}
+		if start > len(items) {
+			start = len(items)
+		}
+		_ = json.NewEncoder(w).Encode(items[start:end])
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/github/users/kubernetes/repos", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gh-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		pages(w, r, []map[string]string{
+			{"full_name": "kubernetes/kubernetes"},
+			{"full_name": "kubernetes/kubectl"},
+			{"full_name": "kubernetes/website"},
+			{"full_name": "kubernetes/kube-state-metrics"},
+			{"full_name": "kubernetes/enhancements"},
+		})
+	})
+	mux.HandleFunc("/github/users/NixOS/repos", func(w http.ResponseWriter, r *http.Request) {
+		pages(w, r, []map[string]string{{"full_name": "NixOS/nix"}, {"full_name": "NixOS/nixpkgs"}})
+	})
+	mux.HandleFunc("/gitlab/groups/gitlab-org/projects", func(w http.ResponseWriter, r *http.Request) {
+		items := []map[string]string{
+			{"path_with_namespace": "gitlab-org/gitlab"},
+			{"path_with_namespace": "gitlab-org/gitaly"},
+		}
+		if r.URL.Query().Get("include_subgroups") == "true" {
+			items = append(items, map[string]string{"path_with_namespace": "gitlab-org/security/gitlab"})
+		}
+		pages(w, r, items)
+	})
+	mux.HandleFunc("/gitlab/users/someone/projects", func(w http.ResponseWriter, r *http.Request) {
+		pages(w, r, []map[string]string{{"path_with_namespace": "someone/dotfiles"}})
+	})
+	mux.HandleFunc("/gitea/users/john/repos", func(w http.ResponseWriter, r *http.Request) {
+		pages(w, r, []map[string]string{{"full_name": "john/doerepo"}, {"full_name": "john/other"}})
+	})
+	mux.HandleFunc("/github/users/octocat/starred", func(w http.ResponseWriter, r *http.Request) {
+		pages(w, r, []map[string]string{
+			{"full_name": "golang/go"},
+			{"full_name": "NixOS/nixpkgs"},
+			{"full_name": "torvalds/linux"},
+		})
+	})
+	mux.HandleFunc("/gitea/users/john/starred", func(w http.ResponseWriter, r *http.Request) {
+		pages(w, r, []map[string]string{{"full_name": "gitea/tea"}})
+	})
+	mux.HandleFunc("/bitbucket/repositories/atlassian", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"values": []map[string]string{{"full_name": "atlassian/python-bitbucket"}},
+			})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"values": []map[string]string{{"full_name": "atlassian/stash"}},
+			"next":   fmt.Sprintf("http://%s/bitbucket/repositories/atlassian?page=2", r.Host),
+		})
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// withProviderAPI points the built-in providers at a local API stand-in
+func withProviderAPI(t *testing.T) {
+	t.Helper()
+	server := newProviderAPI(t)
+	t.Setenv("MM_TEST_GITHUB_TOKEN", "gh-token")
+	withProviders(t, map[string]Provider{
+		"github":    {Kind: "github", Host: "github.com", API: server.URL + "/github", TokenEnv: "MM_TEST_GITHUB_TOKEN"},
+		"gitlab":    {Kind: "gitlab", Host: "gitlab.com", API: server.URL + "/gitlab"},
+		"gitea":     {Kind: "gitea", Host: "gitea.com", API: server.URL + "/gitea"},
+		"bitbucket": {Kind: "bitbucket", Host: "bitbucket.org", API: server.URL + "/bitbucket"},
+	})
+}
+
+func repositoryPaths(repos []Repository) []string {
+	var paths []string
+	for _, repo := range repos {
+		paths = append(paths, repo.Provider+":"+repo.Owner+"/"+repo.Name)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestExpandOwnerPattern(t *testing.T) {
+	withProviderAPI(t)
+
+	tests := []struct {
+		name     string
+		line     string
+		expected []string
+	}{
+		{
+			name: "github organization across pages",
+			line: "github:kubernetes/*",
+			expected: []string{
+				"github:kubernetes/enhancements", "github:kubernetes/kube-state-metrics",
+				"github:kubernetes/kubectl", "github:kubernetes/kubernetes", "github:kubernetes/website",
+			},
+		},
+		{
+			name:     "include pattern on repository names",
+			line:     "github:kubernetes/kube*",
+			expected: []string{"github:kubernetes/kube-state-metrics", "github:kubernetes/kubectl", "github:kubernetes/kubernetes"},
+		},
+		{
+			name:     "gitlab group without subgroups",
+			line:     "gitlab:gitlab-org/*",
+			expected: []string{"gitlab:gitlab-org/gitaly", "gitlab:gitlab-org/gitlab"},
+		},
+		{
+			name:     "gitlab group with subgroups",
+			line:     "gitlab:gitlab-org/**",
+			expected: []string{"gitlab:gitlab-org/gitaly", "gitlab:gitlab-org/gitlab", "gitlab:gitlab-org/security/gitlab"},
+		},
+		{
+			name:     "gitlab user falls back from groups",
+			line:     "gitlab:someone/*",
+			expected: []string{"gitlab:someone/dotfiles"},
+		},
+		{
+			name:     "gitea user falls back from organizations",
+			line:     "gitea:john/*",
+			expected: []string{"gitea:john/doerepo", "gitea:john/other"},
+		},
+		{
+			name:     "bitbucket workspace with next links in the body",
+			line:     "bitbucket:atlassian/*",
+			expected: []string{"bitbucket:atlassian/python-bitbucket", "bitbucket:atlassian/stash"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, err := parseOwnerPattern(tt.line)
+			if err != nil {
+				t.Fatalf("parseOwnerPattern(%q) unexpected error: %v", tt.line, err)
+			}
+			repos, err := expandOwnerPattern(pattern)
+			if err != nil {
+				t.Fatalf("expandOwnerPattern(%q) unexpected error: %v", tt.line, err)
+			}
+
+			paths := repositoryPaths(repos)
+			if fmt.Sprint(paths) != fmt.Sprint(tt.expected) {
+				t.Errorf("expandOwnerPattern(%q) = %v, want %v", tt.line, paths, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExpandOwnerPatternErrors(t *testing.T) {
+	withProviderAPI(t)
+
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"unknown provider", "codeberg:someone/*"},
+		{"provider without listing API", "azure:org/*"},
+		{"owner pattern", "github:kube*/*"},
+		{"unknown owner", "gitea:nobody/*"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, err := parseOwnerPattern(tt.line)
+			if err != nil {
+				return
+			}
+			if _, err := expandOwnerPattern(pattern); err == nil {
+				t.Errorf("expandOwnerPattern(%q) expected error but got none", tt.line)
+			}
+		})
+	}
+}
+
+func TestReadRegistryDiscovery(t *testing.T) {
+	withProviderAPI(t)
+
+	content := `# Everything from kubernetes except the website
+github:kubernetes/*
+!github:kubernetes/website
+!github:kubernetes/kube-*
+gitea:john/doerepo
+`
+	tmpFile := filepath.Join(t.TempDir(), "registry.txt")
+	if err := os.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	repos, err := readRegistry(tmpFile)
+	if err != nil {
+		t.Fatalf("readRegistry() unexpected error: %v", err)
+	}
+
+	expected := []string{"gitea:john/doerepo", "github:kubernetes/enhancements", "github:kubernetes/kubectl", "github:kubernetes/kubernetes"}
+	if paths := repositoryPaths(repos); fmt.Sprint(paths) != fmt.Sprint(expected) {
+		t.Errorf("readRegistry() = %v, want %v", paths, expected)
+	}
+}
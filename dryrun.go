@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// plannedRepository is a registry repository along with what a sync would do
+// with it
+type plannedRepository struct {
+	sourcedRepository
+	Dir    string
+	Action string
+	Synced time.Time
+}
+
+// syncPlan is what a sync of the registry would do
+type syncPlan struct {
+	Repositories []plannedRepository
+	// Patterns are the owner patterns, which are only listed at sync time
+	Patterns []sourcedPattern
+	// Problems are the entries a sync would skip
+	Problems []registryProblem
+}
+
+// planSync computes what a sync of the selected repositories would do,
+// without running git, calling the provider APIs or creating directories.
+// Duplicates are reported as warnings, or as errors in strict mode.
+func planSync(registryFile, mirrorsDir string, filter *repositoryFilter, strict bool) (syncPlan, error) {
+	loader := &registryLoader{noExpand: true}
+	if err := loader.load(registryFile); err != nil {
+		return syncPlan{}, err
+	}
+
+	plan := syncPlan{Problems: loader.problems}
+	entries, duplicates := dedupeRepositories(loader.repositories())
+	severity := severityWarning
+	if strict {
+		severity = severityError
+	}
+	for _, duplicate := range duplicates {
+		plan.Problems = append(plan.Problems, duplicate.problem(severity))
+	}
+
+	for _, entry := range entries {
+		if !filter.selects(entry.Repository) {
+			continue
+		}
+		dir := repositoryDir(mirrorsDir, entry.Repository)
+		action, synced := planMirror(dir, entry.Repository)
+		plan.Repositories = append(plan.Repositories, plannedRepository{
+			sourcedRepository: entry,
+			Dir:               dir,
+			Action:            action,
+			Synced:            synced,
+		})
+	}
+
+	for _, pattern := range loader.patterns {
+		if len(filter.providers) == 0 || slices.Contains(filter.providers, pattern.Provider) {
+			plan.Patterns = append(plan.Patterns, pattern)
+		}
+	}
+
+	return plan, nil
+}
+
+// failed reports whether the registry problems of the plan fail the dry run:
+// any invalid or duplicate entry in strict mode, or more invalid entries
+// than maxParseErrors (-1 for no limit)
+func (p syncPlan) failed(strict bool, maxParseErrors int) bool {
+	invalid := 0
+	for _, problem := range p.Problems {
+		if problem.Severity == severityError {
+			invalid++
+		}
+	}
+	if strict {
+		return invalid > 0
+	}
+	return maxParseErrors >= 0 && invalid > maxParseErrors
+}
+
+// writeSyncPlan prints the planned action of every repository, followed by
+// the entries that would be skipped
+func writeSyncPlan(w io.Writer, plan syncPlan) error {
+	counts := make(map[string]int)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tREPOSITORY\tURL\tDIRECTORY\tSOURCE")
+	for _, repo := range plan.Repositories {
+		counts[repo.Action]++
+		action := repo.Action
+		if repo.Action == actionSkip {
+			action = fmt.Sprintf("skip (synced %s ago)", time.Since(repo.Synced).Round(time.Second))
+		}
+		fmt.Fprintf(tw, "%s\t%s:%s/%s\t%s\t%s\t%s:%d\n", action, repo.Provider, repo.Owner, repo.Name,
+			redactURL(repo.URL), repo.Dir, repo.File, repo.Line)
+	}
+	for _, pattern := range plan.Patterns {
+		fmt.Fprintf(tw, "expand\t%s\t-\t-\t%s:%d\n", pattern.Entry, pattern.File, pattern.Line)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(plan.Problems) > 0 {
+		fmt.Fprintln(w, "\nSkipped entries:")
+		for _, problem := range plan.Problems {
+			fmt.Fprintf(w, "  %s\n", problem.diagnostic())
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "\nDry run: %d to clone, %d to update, %d to skip, %d owner patterns to expand, %d skipped entries\n",
+		counts[actionClone], counts[actionUpdate], counts[actionSkip], len(plan.Patterns), len(plan.Problems))
+	return err
+}
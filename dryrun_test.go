@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanSync(t *testing.T) {
+	source := createSourceRepository(t)
+	tmpDir := t.TempDir()
+	mirrorsDir := filepath.Join(tmpDir, "mirrors")
+	writeRegistryFiles(t, tmpDir, map[string]string{
+		"registry.txt": "github:golang/go\ngithub:golang/tools\ngithub:kubernetes/*\ncodeberg:x/y\n@include extra.json\n",
+		"extra.json":   `{"repositories": [{"repo": "github:golang/net", "interval": "1h"}, {"repo": "github:Golang/Go"}]}`,
+	})
+	for _, name := range []string{"tools", "net"} {
+		runGit(t, tmpDir, "clone", "--quiet", "--mirror", source, filepath.Join(mirrorsDir, "github", "golang", name))
+	}
+	if err := recordSyncTime(filepath.Join(mirrorsDir, "github", "golang", "net"), time.Now()); err != nil {
+		t.Fatalf("recordSyncTime() unexpected error: %v", err)
+	}
+
+	// The owner pattern would fail to expand without an API stand-in
+	plan, err := planSync(filepath.Join(tmpDir, "registry.txt"), mirrorsDir, &repositoryFilter{}, false)
+	if err != nil {
+		t.Fatalf("planSync() unexpected error: %v", err)
+	}
+
+	var actions []string
+	for _, repo := range plan.Repositories {
+		actions = append(actions, repo.Action+" "+repo.Name)
+	}
+	if expected := "clone go, update tools, skip net"; strings.Join(actions, ", ") != expected {
+		t.Errorf("planned actions = %v, want %s", actions, expected)
+	}
+	if len(plan.Patterns) != 1 || plan.Patterns[0].Entry != "github:kubernetes/*" {
+		t.Errorf("planned patterns = %+v, want github:kubernetes/*", plan.Patterns)
+	}
+	if len(plan.Problems) != 2 {
+		t.Errorf("planned problems = %+v, want the parse error and the duplicate", plan.Problems)
+	}
+
+	var out bytes.Buffer
+	if err := writeSyncPlan(&out, plan); err != nil {
+		t.Fatalf("writeSyncPlan() unexpected error: %v", err)
+	}
+	for _, expected := range []string{"https://github.com/golang/go.git", filepath.Join(mirrorsDir, "github", "golang", "go"), "unsupported provider: codeberg"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("plan output should contain %q:\n%s", expected, out.String())
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(mirrorsDir, "github", "golang", "go")); !os.IsNotExist(err) {
+		t.Errorf("planSync() should not create directories, got %v", err)
+	}
+}
+
+func TestSyncPlanFailed(t *testing.T) {
+	parseError := registryProblem{Severity: severityError, Message: "unsupported provider: codeberg"}
+	duplicate := registryProblem{Severity: severityWarning, Message: "github/golang/go is already listed"}
+
+	tests := []struct {
+		name           string
+		problems       []registryProblem
+		strict         bool
+		maxParseErrors int
+		expected       bool
+	}{
+		{"no problems in strict mode", nil, true, -1, false},
+		{"duplicate", []registryProblem{duplicate}, false, -1, false},
+		{"parse error without limit", []registryProblem{parseError}, false, -1, false},
+		{"parse error within the limit", []registryProblem{parseError}, false, 1, false},
+		{"parse error beyond the limit", []registryProblem{parseError}, false, 0, true},
+		{"parse error in strict mode", []registryProblem{parseError}, true, -1, true},
+		{"duplicate in strict mode", []registryProblem{{Severity: severityError}}, true, -1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := syncPlan{Problems: tt.problems}
+			if failed := plan.failed(tt.strict, tt.maxParseErrors); failed != tt.expected {
+				t.Errorf("failed() = %v, want %v", failed, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPlanSyncFilter(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "registry.txt")
+	writeRegistryFiles(t, filepath.Dir(tmpFile), map[string]string{
+		"registry.txt": "github:golang/go\ngitlab:group/project\ngitlab:group/*\n",
+	})
+
+	filter := &repositoryFilter{providers: listFlag{"gitlab"}}
+	plan, err := planSync(tmpFile, t.TempDir(), filter, false)
+	if err != nil {
+		t.Fatalf("planSync() unexpected error: %v", err)
+	}
+	if len(plan.Repositories) != 1 || plan.Repositories[0].Provider != "gitlab" || len(plan.Patterns) != 1 {
+		t.Errorf("planSync() = %+v, want only the gitlab entries", plan)
+	}
+}
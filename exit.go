@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Exit codes of the commands. Usage errors exit with exitConfigError as well,
+// which is the code used by the flag package.
+const (
+	// exitSuccess is every repository synced, or failures within -fail-on
+	exitSuccess = 0
+	// exitPartialFailure is some repositories failing beyond -fail-on, or
+	// some mirrors failing to be collected by gc
+	exitPartialFailure = 1
+	// exitConfigError is invalid flags or configuration, a mirrors directory
+	// or output that cannot be written, or an address that cannot be served
+	exitConfigError = 2
+	// exitTotalFailure is every repository failing, or the stars of a user
+	// that cannot be listed
+	exitTotalFailure = 3
+	// exitRegistryError is a registry that cannot be read or updated, has
+	// more invalid entries than -max-parse-errors allows, or fails validate
+	exitRegistryError = 4
+	// exitLocked is another run holding the mirrors directory, or a mirror
+	// to purge, past -lock-timeout
+	exitLocked = 5
+	// exitInterrupted is a run stopped by SIGINT or SIGTERM, after reporting
+	// the repositories synced so far, like a shell reports a process killed
+	// by SIGINT
+	exitInterrupted = 130
+)
+
+// exitf logs a message and exits with the given code
+func exitf(code int, format string, args ...any) {
+	log.Printf(format, args...)
+	os.Exit(code)
+}
+
+// failureThreshold is the -fail-on setting: the percentage of failed
+// repositories a run tolerates. Zero fails the run on any failure.
+type failureThreshold float64
+
+func (t *failureThreshold) String() string {
+	if *t == 0 {
+		return "any"
+	}
+	return strconv.FormatFloat(float64(*t), 'f', -1, 64) + "%"
+}
+
+// Set accepts "any" or a percentage such as "10%"
+func (t *failureThreshold) Set(value string) error {
+	if value == "any" {
+		*t = 0
+		return nil
+	}
+	percent, found := strings.CutSuffix(value, "%")
+	n, err := strconv.ParseFloat(percent, 64)
+	if !found || err != nil || n < 0 || n > 100 {
+		return fmt.Errorf("expected 'any' or a percentage between 0%% and 100%%, got %q", value)
+	}
+	*t = failureThreshold(n)
+	return nil
+}
+
+// exceeded reports whether failed repositories out of total fail the run
+func (t failureThreshold) exceeded(failed, total int) bool {
+	if failed == 0 || total == 0 {
+		return false
+	}
+	return float64(failed)*100/float64(total) > float64(t)
+}
+
+// syncExitCode returns the exit code of a run with the given summary
+func syncExitCode(summary reportSummary, threshold failureThreshold) int {
+	switch {
+	case !threshold.exceeded(summary.Failed, summary.Total):
+		return exitSuccess
+	case summary.Failed == summary.Total:
+		return exitTotalFailure
+	default:
+		return exitPartialFailure
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFailureThreshold(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+		want    failureThreshold
+	}{
+		{value: "any", want: 0},
+		{value: "10%", want: 10},
+		{value: "2.5%", want: 2.5},
+		{value: "100%", want: 100},
+		{value: "10", wantErr: true},
+		{value: "-1%", wantErr: true},
+		{value: "101%", wantErr: true},
+		{value: "some", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var threshold failureThreshold
+		err := threshold.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && threshold != tt.want {
+			t.Errorf("Set(%q) = %v, want %v", tt.value, threshold, tt.want)
+		}
+	}
+}
+
+func TestSyncExitCode(t *testing.T) {
+	tests := []struct {
+		name      string
+		failed    int
+		total     int
+		threshold failureThreshold
+		want      int
+	}{
+		{"success", 0, 10, 0, exitSuccess},
+		{"empty registry", 0, 0, 0, exitSuccess},
+		{"any failure", 1, 10, 0, exitPartialFailure},
+		{"every repository failed", 10, 10, 0, exitTotalFailure},
+		{"within the threshold", 1, 10, 10, exitSuccess},
+		{"beyond the threshold", 2, 10, 10, exitPartialFailure},
+		{"total failure beyond the threshold", 10, 10, 50, exitTotalFailure},
+		{"never fail", 10, 10, 100, exitSuccess},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summary := reportSummary{Total: tt.total, Failed: tt.failed, Succeeded: tt.total - tt.failed}
+			if code := syncExitCode(summary, tt.threshold); code != tt.want {
+				t.Errorf("syncExitCode() = %d, want %d", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRegistryProblems(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeRegistryFiles(t, tmpDir, map[string]string{
+		"registry.txt": "github:golang/go\ncodeberg:x/y\ngithub:nopath\nhttps://github.com/golang/go.git\n",
+	})
+
+	repos, problems, err := loadRegistryProblems(filepath.Join(tmpDir, "registry.txt"), false)
+	if err != nil {
+		t.Fatalf("loadRegistryProblems() unexpected error: %v", err)
+	}
+	// Duplicates are not parse errors
+	if len(repos) != 1 || len(problems) != 2 {
+		t.Errorf("loadRegistryProblems() = %d repositories, %d problems, want 1 and 2", len(repos), len(problems))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// listFlag is a flag that can be repeated and takes comma-separated values
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// repositoryFilter selects the repositories a command works on. Values of the
+// same kind are alternatives, while every kind that is set must match.
+type repositoryFilter struct {
+	providers listFlag
+	owners    listFlag
+	labels    listFlag
+	matches   []ownerPattern
+}
+
+// addFilterFlags defines the -provider, -owner, -match and -label flags
+func addFilterFlags(flags *flag.FlagSet) *repositoryFilter {
+	f := &repositoryFilter{}
+	flags.Var(&f.providers, "provider", "Only select repositories of these providers (repeatable, comma-separated)")
+	flags.Var(&f.owners, "owner", "Only select repositories of these owners or groups, which may be globs (repeatable, comma-separated)")
+	flags.Func("match", "Only select repositories matching a provider:owner/name glob, like the positional arguments (repeatable)", f.addMatch)
+	flags.Var(&f.labels, "label", "Only select repositories with one of these labels (repeatable, comma-separated)")
+	return f
+}
+
+// addMatch adds a repository selector, which is a short-form entry whose
+// owner and name may be globs, or a clone URL
+func (f *repositoryFilter) addMatch(value string) error {
+	value = strings.TrimSpace(value)
+	if isCloneURL(value) {
+		repo, err := parseRepositoryURL(value)
+		if err != nil {
+			return fmt.Errorf("invalid selector '%s': %v", value, err)
+		}
+		f.matches = append(f.matches, ownerPattern{Provider: repo.Provider, Owner: repo.Owner, Name: repo.Name})
+		return nil
+	}
+
+	pattern, err := parseOwnerPattern(strings.TrimSuffix(value, ".git"))
+	if err != nil {
+		return fmt.Errorf("invalid selector '%s': %v", value, err)
+	}
+	f.matches = append(f.matches, pattern)
+	return nil
+}
+
+// empty reports whether the filter selects every repository
+func (f *repositoryFilter) empty() bool {
+	return len(f.providers) == 0 && len(f.owners) == 0 && len(f.labels) == 0 && len(f.matches) == 0
+}
+
+// selects reports whether repo is selected by the filter. An owner also
+// selects the repositories of its subgroups.
+func (f *repositoryFilter) selects(repo Repository) bool {
+	if len(f.providers) > 0 && !slices.Contains(f.providers, repo.Provider) {
+		return false
+	}
+
+	if len(f.owners) > 0 {
+		selected := false
+		for _, owner := range f.owners {
+			if ok, _ := path.Match(owner, repo.Owner); ok || strings.HasPrefix(repo.Owner, owner+"/") {
+				selected = true
+				break
+			}
+		}
+		if !selected {
+			return false
+		}
+	}
+
+	if len(f.labels) > 0 {
+		if repo.Options == nil {
+			return false
+		}
+		selected := false
+		for _, label := range repo.Options.Labels {
+			if slices.Contains(f.labels, label) {
+				selected = true
+				break
+			}
+		}
+		if !selected {
+			return false
+		}
+	}
+
+	if len(f.matches) == 0 {
+		return true
+	}
+	for _, pattern := range f.matches {
+		if pattern.matches(repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns the repositories selected by the filter, in order
+func (f *repositoryFilter) apply(repos []Repository) []Repository {
+	if f.empty() {
+		return repos
+	}
+	var selected []Repository
+	for _, repo := range repos {
+		if f.selects(repo) {
+			selected = append(selected, repo)
+		}
+	}
+	return selected
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestRepositoryFilter(t *testing.T) {
+	repos := []Repository{
+		{Provider: "github", Owner: "golang", Name: "go"},
+		{Provider: "github", Owner: "golang", Name: "tools", Options: &RepositoryOptions{Labels: []string{"work"}}},
+		{Provider: "github", Owner: "kubernetes", Name: "kubectl"},
+		{Provider: "gitlab", Owner: "gitlab-org/security", Name: "gitlab", Options: &RepositoryOptions{Labels: []string{"infra"}}},
+		{Provider: "git.example.com", Owner: "team", Name: "tool"},
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "no filter",
+			expected: []string{"github:golang/go", "github:golang/tools", "github:kubernetes/kubectl", "gitlab:gitlab-org/security/gitlab", "git.example.com:team/tool"},
+		},
+		{
+			name:     "providers",
+			args:     []string{"-provider", "gitlab,git.example.com"},
+			expected: []string{"gitlab:gitlab-org/security/gitlab", "git.example.com:team/tool"},
+		},
+		{
+			name:     "owner glob",
+			args:     []string{"-owner", "k*"},
+			expected: []string{"github:kubernetes/kubectl"},
+		},
+		{
+			name:     "owner includes subgroups",
+			args:     []string{"-owner", "gitlab-org"},
+			expected: []string{"gitlab:gitlab-org/security/gitlab"},
+		},
+		{
+			name:     "labels",
+			args:     []string{"-label", "work", "-label", "infra"},
+			expected: []string{"github:golang/tools", "gitlab:gitlab-org/security/gitlab"},
+		},
+		{
+			name:     "match with labels",
+			args:     []string{"-match", "github:golang/*", "-label", "work"},
+			expected: []string{"github:golang/tools"},
+		},
+		{
+			name:     "positional selectors",
+			args:     []string{"github:golang/go", "https://git.example.com/team/tool.git"},
+			expected: []string{"github:golang/go", "git.example.com:team/tool"},
+		},
+		{
+			name:     "provider and selector",
+			args:     []string{"-provider", "gitlab", "github:golang/*"},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags.SetOutput(io.Discard)
+			filter := addFilterFlags(flags)
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatalf("Parse(%v) unexpected error: %v", tt.args, err)
+			}
+			for _, selector := range flags.Args() {
+				if err := filter.addMatch(selector); err != nil {
+					t.Fatalf("addMatch(%q) unexpected error: %v", selector, err)
+				}
+			}
+
+			var paths []string
+			for _, repo := range filter.apply(repos) {
+				paths = append(paths, repo.Provider+":"+repo.Owner+"/"+repo.Name)
+			}
+			if fmt.Sprint(paths) != fmt.Sprint(tt.expected) {
+				t.Errorf("apply() = %v, want %v", paths, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRepositoryFilterInvalidSelector(t *testing.T) {
+	filter := &repositoryFilter{}
+	for _, selector := range []string{"golang", "github:golang", "github:golang/[", "ftp://example.com/a/b"} {
+		if err := filter.addMatch(selector); err == nil {
+			t.Errorf("addMatch(%q) expected error but got none", selector)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// runGC packs and prunes the mirrors of the registry. It takes the lock of
+// each mirror in turn, so it can run alongside a sync or serve.
+func runGC(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	common := addRegistryFlags(flags)
+	common.addMirrorsFlag(flags)
+	filter := addFilterFlags(flags)
+	var aggressive = flags.Bool("aggressive", false, "Run git gc --aggressive, which is slower but packs tighter")
+	var lockTimeout = flags.Duration("lock-timeout", 0, "How long to wait for a sync of a repository to finish before skipping it (0 to skip at once)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s gc [flags] [provider:owner/name ...]\n\n", AppName)
+		fmt.Fprintln(flags.Output(), "Runs git gc on the mirrors of the registry, or only the selected ones.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		exitf(exitConfigError, "Failed to parse arguments: %v", err)
+	}
+
+	for _, selector := range flags.Args() {
+		if err := filter.addMatch(selector); err != nil {
+			exitf(exitConfigError, "Failed to parse arguments: %v", err)
+		}
+	}
+
+	registryFile, mirrorsDir := common.load()
+	repos, err := readRegistry(registryFile)
+	if err != nil {
+		exitf(exitRegistryError, "Failed to read registry: %v", err)
+	}
+	repos = filter.apply(repos)
+
+	ctx, stop := notifyContext(context.Background())
+	defer stop()
+
+	var collected, skipped, failed int
+	for _, repo := range repos {
+		if ctx.Err() != nil {
+			break
+		}
+		if !mirrorExists(repositoryDir(mirrorsDir, repo)) {
+			continue
+		}
+
+		name := repo.Owner + "/" + repo.Name
+		before, after, err := gcRepository(ctx, mirrorsDir, repo, *aggressive, *lockTimeout)
+		switch {
+		case errors.Is(err, errLocked):
+			skipped++
+			fmt.Printf("- %s: Skipped, %v\n", name, err)
+		case err != nil:
+			failed++
+			fmt.Printf("✗ %s: %v\n", name, err)
+		default:
+			collected++
+			fmt.Printf("✓ %s: %s → %s\n", name, formatBytes(before), formatBytes(after))
+		}
+	}
+
+	fmt.Printf("\n%d collected, %d skipped, %d failed\n", collected, skipped, failed)
+	switch {
+	case ctx.Err() != nil:
+		os.Exit(exitInterrupted)
+	case failed > 0 && collected == 0 && skipped == 0:
+		os.Exit(exitTotalFailure)
+	case failed > 0:
+		os.Exit(exitPartialFailure)
+	}
+}
+
+// gcRepository runs git gc on the mirror of repo once it holds its lock,
+// waiting up to lockTimeout for it, and returns the size of its objects
+// before and after
+func gcRepository(ctx context.Context, mirrorsDir string, repo Repository, aggressive bool, lockTimeout time.Duration) (int64, int64, error) {
+	repoDir := repositoryDir(mirrorsDir, repo)
+
+	lockCtx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+	lock, err := lockRepository(lockCtx, mirrorsDir, repo, true, "gc")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer lock.release()
+
+	before := objectsSize(repoDir)
+	args := []string{"-C", repoDir, "gc", "--quiet"}
+	if aggressive {
+		args = append(args, "--aggressive")
+	}
+	if stderr, err := runCommand(exec.CommandContext(ctx, "git", args...)); err != nil {
+		return before, before, fmt.Errorf("gc failed: %v: %s", err, lastLine(stderr))
+	}
+	return before, objectsSize(repoDir), nil
+}
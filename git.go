@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lastSyncKey is the git config key, stored in each mirror, holding the time
+// of its last successful sync
+const lastSyncKey = "making-mirrors.lastsync"
+
+// Keys of the git config of each mirror holding the outcome of its last sync,
+// successful or not: when it ran, its action, and its error when it failed
+const (
+	lastAttemptKey = "making-mirrors.lastattempt"
+	lastResultKey  = "making-mirrors.lastresult"
+	lastErrorKey   = "making-mirrors.lasterror"
+)
+
+// killWaitDelay is how long a killed git command may keep its output open,
+// through the helpers it started, before it is abandoned
+const killWaitDelay = 10 * time.Second
+
+// gitCommand builds a git command for repo, killed when ctx is done, applying
+// the credentials profile of the repository when it has one
+func gitCommand(ctx context.Context, repo Repository, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.WaitDelay = killWaitDelay
+
+	if repo.Options == nil || repo.Options.Credentials == "" {
+		return cmd
+	}
+	credentials, ok := credentialProfiles[repo.Options.Credentials]
+	if !ok {
+		return cmd
+	}
+
+	cmd.Env = os.Environ()
+	if credentials.TokenEnv != "" {
+		username := credentials.Username
+		if username == "" {
+			username = "git"
+		}
+		token := os.Getenv(credentials.TokenEnv)
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + token))
+
+		// Passed through the environment so the token never shows up in the
+		// process list
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+	if credentials.SSHKey != "" {
+		cmd.Env = append(cmd.Env,
+			"GIT_SSH_COMMAND=ssh -i "+shellQuote(expandPath(credentials.SSHKey))+" -o IdentitiesOnly=yes")
+	}
+
+	return cmd
+}
+
+// shellQuote quotes s as a single word for the shell that git runs
+// GIT_SSH_COMMAND with
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runCommand runs cmd and returns its error output, which holds the reason
+// of a failure
+func runCommand(cmd *exec.Cmd) (string, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return strings.TrimSpace(stderr.String()), err
+}
+
+// readGit runs a read-only git command in repoDir and returns its output
+func readGit(ctx context.Context, repoDir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", repoDir}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %v: %s", args[0], err, lastLine(stderr.String()))
+	}
+	return output, nil
+}
+
+// runGitCommand runs a git command for repo and returns its error output like
+// runCommand. The command is killed when ctx is done, or when it receives no
+// data for stallTimeout: it neither writes progress nor grows the packs of
+// repoDir. The error is then the reason it was killed.
+func runGitCommand(ctx context.Context, repo Repository, repoDir string, args ...string) (string, error) {
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+
+	var stderr bytes.Buffer
+	var written countingWriter
+	cmd := gitCommand(ctx, repo, args...)
+	cmd.Stderr = io.MultiWriter(&stderr, &written)
+	killProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	if stallTimeout > 0 {
+		progress := func() int64 { return written.n.Load() + packSize(repoDir) }
+		go watchStall(ctx, stallTimeout, progress, stop)
+	}
+
+	err := cmd.Wait()
+	if err != nil && ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+	return stripProgress(stderr.String()), err
+}
+
+// progressLine matches the progress meters of git, like "Receiving objects:
+// 42% (21/50)" or "remote: Counting objects: 12, done."
+var progressLine = regexp.MustCompile(`^(remote: )?[A-Z][a-z ]+: +(\d+% \(\d+/\d+\)|\d+)(,|\s|$)`)
+
+// stripProgress removes the progress meters from the error output of a git
+// command run with --progress, keeping its messages
+func stripProgress(stderr string) string {
+	var lines []string
+	for _, line := range strings.Split(stderr, "\n") {
+		// A meter redraws itself after carriage returns
+		if i := strings.LastIndexByte(line, '\r'); i >= 0 {
+			line = line[i+1:]
+		}
+		if !progressLine.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// initFilteredMirror creates an empty bare mirror that fetches only the refs
+// selected by the repository's ref filter
+func initFilteredMirror(ctx context.Context, repoDir string, repo Repository) error {
+	if err := exec.CommandContext(ctx, "git", "init", "--bare", "--quiet", repoDir).Run(); err != nil {
+		return fmt.Errorf("init failed: %v", err)
+	}
+	if err := exec.CommandContext(ctx, "git", "-C", repoDir, "remote", "add", "--mirror=fetch", "origin", repo.URL).Run(); err != nil {
+		return fmt.Errorf("remote setup failed: %v", err)
+	}
+	return setRefFilter(repoDir, repo.Options.Refs)
+}
+
+// setRefFilter replaces the fetch refspecs of the mirror's origin so that only
+// refs matching the given patterns are mirrored
+func setRefFilter(repoDir string, refs []string) error {
+	// Exits with status 5 when there is nothing to unset, which is fine
+	_ = exec.Command("git", "-C", repoDir, "config", "--unset-all", "remote.origin.fetch").Run()
+
+	for _, ref := range refs {
+		refspec := fmt.Sprintf("+%s:%s", ref, ref)
+		if err := exec.Command("git", "-C", repoDir, "config", "--add", "remote.origin.fetch", refspec).Run(); err != nil {
+			return fmt.Errorf("failed to set ref filter %s: %v", ref, err)
+		}
+	}
+	return nil
+}
+
+// fetchLFS downloads the Git LFS objects of every mirrored ref
+func fetchLFS(ctx context.Context, repoDir string, repo Repository) error {
+	cmd := gitCommand(ctx, repo, "-C", repoDir, "lfs", "fetch", "--all", "origin")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// lastSyncTime returns when the mirror was last synced successfully. The
+// mirror's config file is read directly rather than through git config, so
+// that planning a sync never runs git.
+func lastSyncTime(repoDir string) (time.Time, bool) {
+	value, ok := mirrorConfig(repoDir)[lastSyncKey]
+	if !ok {
+		return time.Time{}, false
+	}
+	synced, err := time.Parse(time.RFC3339, value)
+	return synced, err == nil
+}
+
+// mirrorConfig returns the values that syncs record in the config file of a
+// mirror, by their full lowercase key
+func mirrorConfig(repoDir string) map[string]string {
+	values := make(map[string]string)
+	content, err := os.ReadFile(filepath.Join(repoDir, "config"))
+	if err != nil {
+		return values
+	}
+
+	section, _, _ := strings.Cut(lastSyncKey, ".")
+	inSection := false
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inSection = strings.EqualFold(strings.Trim(line, "[]"), section)
+			continue
+		}
+		name, value, found := strings.Cut(line, "=")
+		if !inSection || !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		values[section+"."+strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	return values
+}
+
+// recordSyncResult stores the outcome of a sync in the mirror: the time of
+// the attempt, its action and, for a failure, its error, along with the time
+// of a successful sync
+func recordSyncResult(repoDir string, result Result, synced time.Time) error {
+	values := [][2]string{
+		{lastAttemptKey, synced.UTC().Format(time.RFC3339)},
+		{lastResultKey, result.Action},
+	}
+	if !result.Succeeded() {
+		values = append(values, [2]string{lastErrorKey, result.Category + ": " + result.errorMessage()})
+	}
+	for _, value := range values {
+		if err := exec.Command("git", "-C", repoDir, "config", value[0], value[1]).Run(); err != nil {
+			return err
+		}
+	}
+	if !result.Succeeded() {
+		return nil
+	}
+	// Exits with 5 when there was no error to clear
+	_ = exec.Command("git", "-C", repoDir, "config", "--unset", lastErrorKey).Run()
+	return recordSyncTime(repoDir, synced)
+}
+
+// recordSyncTime stores the time of a successful sync in the mirror
+func recordSyncTime(repoDir string, synced time.Time) error {
+	return exec.Command("git", "-C", repoDir, "config", lastSyncKey, synced.UTC().Format(time.RFC3339)).Run()
+}
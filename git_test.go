@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runGit runs a git command in dir with a fixed identity and returns its
+// trimmed output
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// createSourceRepository creates a repository with a main and a dev branch
+// and a v1.0.0 tag, to be used as the remote of a mirror
+func createSourceRepository(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available, skipping integration tests")
+	}
+
+	dir := filepath.Join(t.TempDir(), "source")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create source directory: %v", err)
+	}
+	runGit(t, dir, "init", "--quiet", "--initial-branch=main")
+	if err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("# source\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	runGit(t, dir, "add", "README.md")
+	runGit(t, dir, "commit", "--quiet", "-m", "Initial commit")
+	runGit(t, dir, "tag", "v1.0.0")
+	runGit(t, dir, "branch", "dev")
+	return dir
+}
+
+func TestMirrorRepositoryRefFilter(t *testing.T) {
+	source := createSourceRepository(t)
+	mirrorsDir := t.TempDir()
+
+	repo := Repository{
+		Provider: "local",
+		Owner:    "test",
+		Name:     "source",
+		URL:      source,
+		Options:  &RepositoryOptions{Refs: []string{"refs/heads/main", "refs/tags/*"}},
+	}
+
+	result := mirrorRepository(context.Background(), mirrorsDir, repo)
+	if !result.Succeeded() {
+		t.Fatalf("mirrorRepository() = %s, want success", result)
+	}
+
+	refs := runGit(t, repositoryDir(mirrorsDir, repo), "for-each-ref", "--format=%(refname)")
+	if !strings.Contains(refs, "refs/heads/main") || !strings.Contains(refs, "refs/tags/v1.0.0") {
+		t.Errorf("mirror refs = %q, want main and v1.0.0", refs)
+	}
+	if strings.Contains(refs, "refs/heads/dev") {
+		t.Errorf("mirror refs = %q, dev should be filtered out", refs)
+	}
+}
+
+func TestMirrorRepositoryInterval(t *testing.T) {
+	source := createSourceRepository(t)
+	mirrorsDir := t.TempDir()
+
+	repo := Repository{
+		Provider: "local",
+		Owner:    "test",
+		Name:     "source",
+		URL:      source,
+		Options:  &RepositoryOptions{Interval: time.Hour},
+	}
+
+	if result := mirrorRepository(context.Background(), mirrorsDir, repo); result.Action != resultCloned {
+		t.Fatalf("first mirrorRepository() = %s, want clone", result)
+	}
+
+	synced, ok := lastSyncTime(repositoryDir(mirrorsDir, repo))
+	if !ok || time.Since(synced) > time.Minute {
+		t.Errorf("lastSyncTime() = %v, %v, want a recent time", synced, ok)
+	}
+
+	if result := mirrorRepository(context.Background(), mirrorsDir, repo); result.Action != resultSkipped {
+		t.Errorf("second mirrorRepository() = %s, want skip within the interval", result)
+	}
+}
+
+func TestMirrorRepositorySyncResult(t *testing.T) {
+	source := createSourceRepository(t)
+	mirrorsDir := t.TempDir()
+	repo := Repository{Provider: "local", Owner: "test", Name: "source", URL: source}
+	repoDir := repositoryDir(mirrorsDir, repo)
+
+	if result := mirrorRepository(context.Background(), mirrorsDir, repo); !result.Succeeded() {
+		t.Fatalf("first mirrorRepository() = %s, want success", result)
+	}
+	if config := mirrorConfig(repoDir); config[lastResultKey] != resultCloned || config[lastAttemptKey] == "" {
+		t.Errorf("mirrorConfig() after a clone = %v, want the cloned result", config)
+	}
+
+	// The update fails while the source is gone, and the mirror keeps why
+	moved := source + ".moved"
+	if err := os.Rename(source, moved); err != nil {
+		t.Fatalf("Failed to move source: %v", err)
+	}
+	if result := mirrorRepository(context.Background(), mirrorsDir, repo); result.Succeeded() {
+		t.Fatalf("mirrorRepository() without its source = %s, want failure", result)
+	}
+	config := mirrorConfig(repoDir)
+	if config[lastResultKey] != resultFailed || config[lastErrorKey] == "" {
+		t.Errorf("mirrorConfig() after a failure = %v, want the error", config)
+	}
+	if config[lastSyncKey] == "" {
+		t.Errorf("mirrorConfig() after a failure = %v, want the last successful sync kept", config)
+	}
+
+	if err := os.Rename(moved, source); err != nil {
+		t.Fatalf("Failed to restore source: %v", err)
+	}
+	if result := mirrorRepository(context.Background(), mirrorsDir, repo); !result.Succeeded() {
+		t.Fatalf("mirrorRepository() = %s, want success", result)
+	}
+	if config := mirrorConfig(repoDir); config[lastResultKey] == resultFailed || config[lastErrorKey] != "" {
+		t.Errorf("mirrorConfig() after a recovery = %v, want the error cleared", config)
+	}
+}
+
+func TestGitCommandCredentials(t *testing.T) {
+	saved := credentialProfiles
+	credentialProfiles = map[string]Credentials{
+		"token": {Username: "bot", TokenEnv: "MM_TEST_TOKEN"},
+		"ssh":   {SSHKey: "/keys/id_mirror"},
+	}
+	t.Cleanup(func() { credentialProfiles = saved })
+	t.Setenv("MM_TEST_TOKEN", "secret")
+
+	cmd := gitCommand(context.Background(), Repository{Options: &RepositoryOptions{Credentials: "token"}}, "fetch")
+	// "bot:secret" in base64
+	if !containsEnv(cmd.Env, "GIT_CONFIG_VALUE_0=Authorization: Basic Ym90OnNlY3JldA==") {
+		t.Errorf("token credentials not applied: %v", cmd.Env)
+	}
+	if strings.Contains(strings.Join(cmd.Args, " "), "secret") {
+		t.Errorf("token leaked into arguments: %v", cmd.Args)
+	}
+
+	cmd = gitCommand(context.Background(), Repository{Options: &RepositoryOptions{Credentials: "ssh"}}, "fetch")
+	if !containsEnv(cmd.Env, `GIT_SSH_COMMAND=ssh -i '/keys/id_mirror' -o IdentitiesOnly=yes`) {
+		t.Errorf("ssh credentials not applied: %v", cmd.Env)
+	}
+
+	cmd = gitCommand(context.Background(), Repository{}, "fetch")
+	if cmd.Env != nil {
+		t.Errorf("repository without credentials should inherit the environment, got %v", cmd.Env)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	for _, value := range []string{"/keys/id_mirror", `/keys/my key`, `/keys/it's`, `/keys/$HOME/"x"\y`} {
+		output, err := exec.Command("sh", "-c", "printf %s "+shellQuote(value)).Output()
+		if err != nil {
+			t.Fatalf("sh failed for %q: %v", value, err)
+		}
+		if string(output) != value {
+			t.Errorf("shellQuote(%q) reads back as %q", value, output)
+		}
+	}
+}
+
+func containsEnv(env []string, entry string) bool {
+	for _, e := range env {
+		if e == entry {
+			return true
+		}
+	}
+	return false
+}
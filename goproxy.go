@@ -0,0 +1,775 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// goModuleVanityPrefixes maps the module paths of vanity import servers to
+// the repositories they redirect to
+var goModuleVanityPrefixes = map[string]string{
+	"golang.org/x/": "github.com/golang/",
+}
+
+// Limits of module zips, as enforced by the go command
+const (
+	maxGoModuleZipSize = 500 << 20
+	maxGoModFileSize   = 16 << 20
+)
+
+// errModuleNotFound matches the errors of modules and versions that the
+// mirrors do not have, answered with 404 so that the go command moves on to
+// the next proxy
+var errModuleNotFound = errors.New("not found")
+
+var (
+	// majorSuffix matches the major version element of a module path, as in
+	// github.com/go-chi/chi/v5
+	majorSuffix = regexp.MustCompile(`^v([2-9]|[1-9][0-9]+)$`)
+
+	// pseudoVersion matches the versions made up for untagged commits, like
+	// v0.0.0-20191109021931-daa7c04131f5
+	pseudoVersion = regexp.MustCompile(`^v[0-9]+\.(0\.0-|\d+\.\d+-([^+]*\.)?0\.)(\d{14})-([0-9a-f]{12})$`)
+
+	// revisionQuery matches the branch names and commit hashes accepted as
+	// version queries
+	revisionQuery = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/+-]*$`)
+)
+
+// goModule is a Go module in a mirror
+type goModule struct {
+	// path is the module path, like github.com/golang/tools/gopls
+	path    string
+	repo    Repository
+	repoDir string
+	// dir is the directory of the module in the repository, which also
+	// prefixes its tags, or "" for the root
+	dir string
+	// major is the major version suffix of the path, like v2, or ""
+	major string
+}
+
+// goModuleInfo is the JSON document of the .info and @latest endpoints
+type goModuleInfo struct {
+	Version string
+	Time    time.Time
+}
+
+// isGoProxyPath reports whether a request path is one of the endpoints of
+// the module proxy protocol
+func isGoProxyPath(urlPath string) bool {
+	return strings.Contains(urlPath, "/@v/") || strings.HasSuffix(urlPath, "/@latest")
+}
+
+// serveGoProxy answers the module proxy protocol of the go command:
+// <module>/@v/list, <module>/@v/<version>.info, .mod and .zip, and
+// <module>/@latest
+func (s *gitServer) serveGoProxy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	escapedPath, endpoint, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/@v/")
+	if !found {
+		escapedPath, endpoint = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/@latest"), "@latest"
+	}
+	modPath, ok := unescapeModulePath(escapedPath)
+	if !ok {
+		http.Error(w, "Invalid module path", http.StatusBadRequest)
+		return
+	}
+	module, ok := s.resolveGoModule(modPath)
+	if !ok {
+		http.Error(w, "Module not found: "+modPath, http.StatusNotFound)
+		return
+	}
+
+	lock, err := s.lock(r.Context(), module.repo)
+	if err != nil {
+		log.Printf("Warning: %s: %v", modPath, err)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "The mirror is being updated, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer lock.release()
+
+	err = module.serve(r.Context(), w, endpoint)
+	if errors.Is(err, errModuleNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+	} else if err != nil {
+		log.Printf("Warning: %s/@v/%s: %v", modPath, endpoint, err)
+		http.Error(w, "Failed to read the mirror", http.StatusInternalServerError)
+	}
+}
+
+// serve answers a single endpoint of the module proxy protocol for m
+func (m *goModule) serve(ctx context.Context, w http.ResponseWriter, endpoint string) error {
+	if endpoint == "list" {
+		versions, err := m.versions(ctx)
+		if err != nil {
+			return err
+		}
+		var list []string
+		for version := range versions {
+			list = append(list, version)
+		}
+		slices.SortFunc(list, compareSemver)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, version := range list {
+			fmt.Fprintln(w, version)
+		}
+		return nil
+	}
+
+	if endpoint == "@latest" {
+		info, _, err := m.latest(ctx)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, info)
+	}
+
+	ext := path.Ext(endpoint)
+	version, ok := unescapeModulePath(strings.TrimSuffix(endpoint, ext))
+	if !ok {
+		return fmt.Errorf("%w: invalid version %q", errModuleNotFound, endpoint)
+	}
+	switch ext {
+	case ".info":
+		info, _, err := m.query(ctx, version)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, info)
+	case ".mod":
+		commit, err := m.resolve(ctx, version)
+		if err != nil {
+			return err
+		}
+		_, goMod, err := m.goMod(ctx, commit)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = w.Write(goMod)
+		return err
+	case ".zip":
+		commit, err := m.resolve(ctx, version)
+		if err != nil {
+			return err
+		}
+		return m.writeZip(ctx, w, version, commit)
+	}
+	return fmt.Errorf("%w: unknown endpoint %q", errModuleNotFound, endpoint)
+}
+
+// resolveGoModule finds the mirror of a module path: the longest prefix of the
+// path that is a repository of the registry on the host of a provider, the
+// rest being the directory of the module in the repository
+func (s *gitServer) resolveGoModule(modPath string) (*goModule, bool) {
+	repoPath := modPath
+	for prefix, target := range goModuleVanityPrefixes {
+		if rest, found := strings.CutPrefix(modPath, prefix); found {
+			repoPath = target + rest
+		}
+	}
+
+	var major string
+	if i := strings.LastIndex(repoPath, "/"); i >= 0 && majorSuffix.MatchString(repoPath[i+1:]) {
+		repoPath, major = repoPath[:i], repoPath[i+1:]
+	}
+
+	host, rest, found := strings.Cut(repoPath, "/")
+	provider, ok := providerForHost(host)
+	if !found || !ok {
+		return nil, false
+	}
+	segments := strings.Split(rest, "/")
+	for n := len(segments); n >= 2; n-- {
+		repo, ok := s.exports.lookup(provider + "/" + strings.Join(segments[:n], "/"))
+		if !ok || !mirrorExists(repositoryDir(s.mirrorsDir, repo)) {
+			continue
+		}
+		return &goModule{
+			path:    modPath,
+			repo:    repo,
+			repoDir: repositoryDir(s.mirrorsDir, repo),
+			dir:     strings.Join(segments[n:], "/"),
+			major:   major,
+		}, true
+	}
+	return nil, false
+}
+
+// tagPrefix returns the prefix of the version tags of m, like gopls/
+func (m *goModule) tagPrefix() string {
+	if m.dir == "" {
+		return ""
+	}
+	return m.dir + "/"
+}
+
+// compatible reports whether version belongs to the major version of m
+func (m *goModule) compatible(version string) bool {
+	major, _, _ := strings.Cut(version, ".")
+	if m.major == "" {
+		return major == "v0" || major == "v1"
+	}
+	return major == m.major
+}
+
+// versions returns the tagged versions of m with their tags
+func (m *goModule) versions(ctx context.Context) (map[string]string, error) {
+	output, err := readGit(ctx, m.repoDir, "for-each-ref", "--format=%(refname:strip=2)", strings.TrimSuffix("refs/tags/"+m.tagPrefix(), "/"))
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string]string)
+	for _, tag := range strings.Fields(string(output)) {
+		version := strings.TrimPrefix(tag, m.tagPrefix())
+		if isSemver(version) && m.compatible(version) {
+			versions[version] = tag
+		}
+	}
+	return versions, nil
+}
+
+// latest returns the highest release of m, or the highest prerelease when
+// there is none, or a pseudo-version of the default branch when it has no
+// versions at all
+func (m *goModule) latest(ctx context.Context) (goModuleInfo, string, error) {
+	versions, err := m.versions(ctx)
+	if err != nil {
+		return goModuleInfo{}, "", err
+	}
+	var latest string
+	for version := range versions {
+		if latest == "" || (isPrerelease(latest) && !isPrerelease(version)) ||
+			(isPrerelease(latest) == isPrerelease(version) && compareSemver(version, latest) > 0) {
+			latest = version
+		}
+	}
+	if latest != "" {
+		return m.query(ctx, latest)
+	}
+	return m.query(ctx, "HEAD")
+}
+
+// query returns the version and commit of a version, a pseudo-version, or a
+// branch name or commit hash, for which it returns the version of a tag of
+// the commit or else a pseudo-version
+func (m *goModule) query(ctx context.Context, query string) (goModuleInfo, string, error) {
+	if isSemver(query) || pseudoVersion.MatchString(query) {
+		commit, err := m.resolve(ctx, query)
+		if err != nil {
+			return goModuleInfo{}, "", err
+		}
+		commitTime, err := m.commitTime(ctx, commit)
+		return goModuleInfo{Version: query, Time: commitTime}, commit, err
+	}
+
+	commit, commitTime, err := m.commit(ctx, query)
+	if err != nil {
+		return goModuleInfo{}, "", err
+	}
+	if _, _, err := m.goMod(ctx, commit); err != nil {
+		return goModuleInfo{}, "", err
+	}
+
+	// A tagged commit is known by its version
+	output, err := readGit(ctx, m.repoDir, "tag", "--points-at", commit)
+	if err != nil {
+		return goModuleInfo{}, "", err
+	}
+	var tagged []string
+	for _, tag := range strings.Fields(string(output)) {
+		version, found := strings.CutPrefix(tag, m.tagPrefix())
+		if found && isSemver(version) && m.compatible(version) {
+			tagged = append(tagged, version)
+		}
+	}
+	if len(tagged) > 0 {
+		return goModuleInfo{Version: slices.MaxFunc(tagged, compareSemver), Time: commitTime}, commit, nil
+	}
+
+	version, err := m.pseudoVersion(ctx, commit, commitTime)
+	return goModuleInfo{Version: version, Time: commitTime}, commit, err
+}
+
+// resolve returns the commit of a version or pseudo-version of m, checking
+// that the module exists there
+func (m *goModule) resolve(ctx context.Context, version string) (string, error) {
+	var commit string
+	switch {
+	case !m.compatible(version):
+		return "", fmt.Errorf("%w: %s is not a version of %s", errModuleNotFound, version, m.path)
+	case isSemver(version):
+		versions, err := m.versions(ctx)
+		if err != nil {
+			return "", err
+		}
+		tag, ok := versions[version]
+		if !ok {
+			return "", fmt.Errorf("%w: no version %s of %s", errModuleNotFound, version, m.path)
+		}
+		if commit, _, err = m.commit(ctx, "refs/tags/"+tag); err != nil {
+			return "", err
+		}
+	case pseudoVersion.MatchString(version):
+		match := pseudoVersion.FindStringSubmatch(version)
+		hash, commitTime, err := m.commit(ctx, match[4])
+		if err != nil {
+			return "", err
+		}
+		if !strings.HasPrefix(hash, match[4]) || commitTime.Format(pseudoVersionTime) != match[3] {
+			return "", fmt.Errorf("%w: pseudo-version %s does not match commit %s", errModuleNotFound, version, hash)
+		}
+		commit = hash
+	default:
+		return "", fmt.Errorf("%w: invalid version %q", errModuleNotFound, version)
+	}
+
+	if _, _, err := m.goMod(ctx, commit); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// commit returns the hash and time of the commit of a revision
+func (m *goModule) commit(ctx context.Context, rev string) (string, time.Time, error) {
+	if !revisionQuery.MatchString(rev) || strings.Contains(rev, "..") {
+		return "", time.Time{}, fmt.Errorf("%w: invalid revision %q", errModuleNotFound, rev)
+	}
+	output, err := readGit(ctx, m.repoDir, "log", "-1", "--format=%H %ct", "--end-of-options", rev, "--")
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("%w: unknown revision %s", errModuleNotFound, rev)
+	}
+	hash, seconds, _ := strings.Cut(strings.TrimSpace(string(output)), " ")
+	unix, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid commit time %q", seconds)
+	}
+	return hash, time.Unix(unix, 0).UTC(), nil
+}
+
+func (m *goModule) commitTime(ctx context.Context, commit string) (time.Time, error) {
+	_, commitTime, err := m.commit(ctx, commit)
+	return commitTime, err
+}
+
+// pseudoVersionTime is the layout of the time in pseudo-versions
+const pseudoVersionTime = "20060102150405"
+
+// pseudoVersion returns the pseudo-version of an untagged commit, built on
+// the highest version tagged on its history like the go command does:
+// vX.0.0-time-hash without one, vX.Y.(Z+1)-0.time-hash after the release
+// vX.Y.Z, and vX.Y.Z-pre.0.time-hash after the prerelease vX.Y.Z-pre
+func (m *goModule) pseudoVersion(ctx context.Context, commit string, commitTime time.Time) (string, error) {
+	output, err := readGit(ctx, m.repoDir, "tag", "--merged", commit)
+	if err != nil {
+		return "", err
+	}
+	var base string
+	for _, tag := range strings.Fields(string(output)) {
+		version, found := strings.CutPrefix(tag, m.tagPrefix())
+		if found && isSemver(version) && m.compatible(version) && (base == "" || compareSemver(version, base) > 0) {
+			base = version
+		}
+	}
+
+	suffix := commitTime.UTC().Format(pseudoVersionTime) + "-" + commit[:12]
+	switch {
+	case base == "":
+		major := m.major
+		if major == "" {
+			major = "v0"
+		}
+		return major + ".0.0-" + suffix, nil
+	case isPrerelease(base):
+		return base + ".0." + suffix, nil
+	}
+	i := strings.LastIndex(base, ".")
+	patch, err := strconv.ParseUint(base[i+1:], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid version %s", base)
+	}
+	return fmt.Sprintf("%s.%d-0.%s", base[:i], patch+1, suffix), nil
+}
+
+// goMod returns the directory of m in the repository at commit and its
+// go.mod file. A module with a major version suffix may live in a
+// subdirectory named after it; a module without go.mod gets one naming its
+// path, unless it is in a subdirectory or has a major version suffix, which
+// take a go.mod.
+func (m *goModule) goMod(ctx context.Context, commit string) (string, []byte, error) {
+	var dirs []string
+	if m.major != "" {
+		dirs = append(dirs, path.Join(m.dir, m.major))
+	}
+	dirs = append(dirs, m.dir)
+
+	for _, dir := range dirs {
+		content, err := readGit(ctx, m.repoDir, "cat-file", "blob", commit+":"+path.Join(dir, "go.mod"))
+		if err != nil {
+			continue
+		}
+		if declared := goModulePath(content); declared != m.path {
+			return "", nil, fmt.Errorf("%w: %s/go.mod declares the module as %s", errModuleNotFound, dir, declared)
+		}
+		return dir, content, nil
+	}
+
+	if m.major != "" || m.dir != "" {
+		return "", nil, fmt.Errorf("%w: no go.mod for %s at %.12s", errModuleNotFound, m.path, commit)
+	}
+	return "", []byte("module " + m.path + "\n"), nil
+}
+
+// goModulePath returns the path declared by the module directive of a go.mod
+func goModulePath(goMod []byte) string {
+	for _, line := range strings.Split(string(goMod), "\n") {
+		line, _, _ = strings.Cut(line, "//")
+		if rest, found := strings.CutPrefix(strings.TrimSpace(line), "module"); found && rest != strings.TrimLeft(rest, " \t") {
+			return strings.Trim(strings.TrimSpace(rest), "\"`")
+		}
+	}
+	return ""
+}
+
+// writeZip writes the module zip of m at commit: the files of its directory
+// minus those of nested modules and vendored packages, as the go command
+// selects them, so that the checksums match go.sum
+func (m *goModule) writeZip(ctx context.Context, w http.ResponseWriter, version, commit string) error {
+	dir, _, err := m.goMod(ctx, commit)
+	if err != nil {
+		return err
+	}
+	tree := commit
+	if dir != "" {
+		tree = commit + ":" + dir
+	}
+	files, err := listTree(ctx, m.repoDir, tree, true)
+	if err != nil {
+		return err
+	}
+	files = goModuleFiles(files)
+
+	// A module in a subdirectory without a license of its own gets the one
+	// of the repository
+	if dir != "" && !slices.ContainsFunc(files, func(f treeFile) bool { return f.path == "LICENSE" }) {
+		root, err := listTree(ctx, m.repoDir, commit, true)
+		if err != nil {
+			return err
+		}
+		if i := slices.IndexFunc(root, func(f treeFile) bool { return f.path == "LICENSE" && f.regular() }); i >= 0 {
+			files = append(files, root[i])
+		}
+	}
+
+	var total int64
+	for _, file := range files {
+		total += file.size
+		if total > maxGoModuleZipSize || (file.path == "go.mod" && file.size > maxGoModFileSize) {
+			return fmt.Errorf("module %s@%s is too large", m.path, version)
+		}
+	}
+
+	// Built in a temporary file so that a failure is answered with an error
+	// rather than a truncated zip
+	temp, err := os.CreateTemp("", "making-mirrors-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	blobs, err := newBlobReader(ctx, m.repoDir)
+	if err != nil {
+		return err
+	}
+	defer blobs.close()
+
+	zw := zip.NewWriter(temp)
+	for _, file := range files {
+		fw, err := zw.Create(m.path + "@" + version + "/" + file.path)
+		if err != nil {
+			return err
+		}
+		if err := blobs.read(file.object, fw); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	size, err := temp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	_, err = io.Copy(w, temp)
+	return err
+}
+
+// treeFile is an entry of git ls-tree
+type treeFile struct {
+	mode string
+	// kind is the object type: blob, tree, or commit for a submodule
+	kind   string
+	object string
+	size   int64
+	path   string
+}
+
+// regular reports whether the entry is a regular file, not a symbolic link
+// or a submodule
+func (f treeFile) regular() bool {
+	return f.mode == "100644" || f.mode == "100755"
+}
+
+// listTree lists the entries of a tree, or all the files under it when
+// recursive is set
+func listTree(ctx context.Context, repoDir, tree string, recursive bool) ([]treeFile, error) {
+	args := []string{"ls-tree", "-l", "-z"}
+	if recursive {
+		args = append(args, "-r")
+	}
+	output, err := readGit(ctx, repoDir, append(args, "--end-of-options", tree)...)
+	if err != nil {
+		return nil, err
+	}
+	var files []treeFile
+	for _, entry := range strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00") {
+		info, name, found := strings.Cut(entry, "\t")
+		fields := strings.Fields(info)
+		if !found || len(fields) != 4 {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[3], 10, 64)
+		files = append(files, treeFile{mode: fields[0], kind: fields[1], object: fields[2], size: size, path: name})
+	}
+	return files, nil
+}
+
+// goModuleFiles filters the files of a module directory like the go command
+// does when it zips a module
+func goModuleFiles(files []treeFile) []treeFile {
+	// Directories holding a go.mod are other modules
+	nested := make(map[string]bool)
+	for _, file := range files {
+		dir, base := path.Split(file.path)
+		if strings.EqualFold(base, "go.mod") && file.regular() {
+			nested[dir] = true
+		}
+	}
+	inNestedModule := func(name string) bool {
+		for {
+			dir, _ := path.Split(name)
+			if dir == "" {
+				return false
+			}
+			if nested[dir] {
+				return true
+			}
+			name = dir[:len(dir)-1]
+		}
+	}
+
+	var kept []treeFile
+	for _, file := range files {
+		if !file.regular() || isVendoredPackage(file.path) || inNestedModule(file.path) || file.path == ".hg_archival.txt" {
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
+
+// isVendoredPackage reports whether a file is in a vendored package, with
+// the offset quirk of the go command kept for checksums to match
+func isVendoredPackage(name string) bool {
+	var i int
+	if strings.HasPrefix(name, "vendor/") {
+		i += len("vendor/")
+	} else if j := strings.Index(name, "/vendor/"); j >= 0 {
+		i += len("/vendor/")
+	} else {
+		return false
+	}
+	return strings.Contains(name[i:], "/")
+}
+
+// blobReader reads blobs through a single git cat-file --batch process
+type blobReader struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func newBlobReader(ctx context.Context, repoDir string) (*blobReader, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", repoDir, "cat-file", "--batch")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &blobReader{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// read copies the content of a blob to w
+func (b *blobReader) read(object string, w io.Writer) error {
+	if _, err := fmt.Fprintln(b.stdin, object); err != nil {
+		return err
+	}
+	header, err := b.stdout.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 || fields[1] != "blob" {
+		return fmt.Errorf("failed to read blob %s: %s", object, strings.TrimSpace(header))
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, b.stdout, size); err != nil {
+		return err
+	}
+	_, err = b.stdout.ReadByte()
+	return err
+}
+
+func (b *blobReader) close() {
+	b.stdin.Close()
+	_ = b.cmd.Wait()
+}
+
+// unescapeModulePath decodes the case encoding of module paths and versions
+// in proxy URLs, where an uppercase letter is written as ! and the letter
+func unescapeModulePath(escaped string) (string, bool) {
+	var b strings.Builder
+	bang := false
+	for _, r := range escaped {
+		switch {
+		case bang:
+			if r < 'a' || r > 'z' {
+				return "", false
+			}
+			b.WriteRune(r - 'a' + 'A')
+			bang = false
+		case r == '!':
+			bang = true
+		case r >= 'A' && r <= 'Z':
+			return "", false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if bang || b.Len() == 0 {
+		return "", false
+	}
+	return b.String(), true
+}
+
+func writeJSON(w http.ResponseWriter, value any) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(append(content, '\n'))
+	return err
+}
+
+// semverPattern matches the canonical semantic versions used as module
+// versions: vMAJOR.MINOR.PATCH with an optional prerelease, without build
+// metadata
+var semverPattern = regexp.MustCompile(`^v(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(-(0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(\.(0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*)?$`)
+
+// isSemver reports whether version is a tagged version, rather than a
+// pseudo-version or any other string
+func isSemver(version string) bool {
+	return semverPattern.MatchString(version) && !pseudoVersion.MatchString(version)
+}
+
+func isPrerelease(version string) bool {
+	return strings.Contains(version, "-")
+}
+
+// compareSemver orders semantic versions by precedence
+func compareSemver(a, b string) int {
+	aCore, aPre, _ := strings.Cut(strings.TrimPrefix(a, "v"), "-")
+	bCore, bPre, _ := strings.Cut(strings.TrimPrefix(b, "v"), "-")
+	if c := compareDotted(aCore, bCore, true); c != 0 {
+		return c
+	}
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	}
+	return compareDotted(aPre, bPre, false)
+}
+
+// compareDotted compares dot-separated identifiers, numeric ones by value and
+// below alphanumeric ones, the shorter list first when one is a prefix
+func compareDotted(a, b string, numeric bool) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		x, y := aParts[i], bParts[i]
+		xNum, yNum := numeric || isDigits(x), numeric || isDigits(y)
+		switch {
+		case xNum && yNum:
+			if c := len(x) - len(y); c != 0 {
+				return c
+			}
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+		case xNum:
+			return -1
+		case yNum:
+			return 1
+		default:
+			if c := strings.Compare(x, y); c != 0 {
+				return c
+			}
+		}
+	}
+	return len(aParts) - len(bParts)
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createModuleRepository creates a repository holding the module
+// github.com/test/mod tagged v1.0.0 and v1.1.0-rc.1, its v2 in a major
+// subdirectory tagged v2.0.0, and the nested module github.com/test/mod/sub
+// tagged sub/v0.1.0, followed by an untagged commit
+func createModuleRepository(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available, skipping integration tests")
+	}
+	dir := filepath.Join(t.TempDir(), "mod")
+	writeFiles := func(files map[string]string) {
+		t.Helper()
+		for name, content := range files {
+			path := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatalf("Failed to create directory: %v", err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+		}
+		runGit(t, dir, "add", "-A")
+		runGit(t, dir, "commit", "--quiet", "-m", "Update")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	runGit(t, dir, "init", "--quiet", "--initial-branch=main")
+	writeFiles(map[string]string{
+		"go.mod":                    "module github.com/test/mod\n\ngo 1.22\n",
+		"mod.go":                    "package mod\n",
+		"LICENSE":                   "license\n",
+		"vendor/modules.txt":        "# vendored\n",
+		"vendor/x/y/y.go":           "package y\n",
+		"sub/go.mod":                "module github.com/test/mod/sub\n",
+		"sub/sub.go":                "package sub\n",
+		"v2/go.mod":                 "module github.com/test/mod/v2 // v2 in a subdirectory\n",
+		"v2/mod.go":                 "package mod\n",
+		"internal/testdata/x":       "data\n",
+		"internal/.hg_archival.txt": "hg\n",
+		".hg_archival.txt":          "hg\n",
+	})
+	runGit(t, dir, "tag", "v1.0.0")
+	runGit(t, dir, "tag", "sub/v0.1.0")
+	runGit(t, dir, "tag", "v2.0.0")
+	runGit(t, dir, "tag", "not-a-version")
+	writeFiles(map[string]string{"mod.go": "package mod // rc\n"})
+	runGit(t, dir, "tag", "-a", "-m", "Release candidate", "v1.1.0-rc.1")
+	writeFiles(map[string]string{"mod.go": "package mod // next\n"})
+	return dir
+}
+
+// serveGoProxy mirrors the module repository as github/test/mod and serves
+// it with the module proxy protocol enabled
+func serveGoProxy(t *testing.T) (string, string) {
+	t.Helper()
+	source := createModuleRepository(t)
+	mirrorsDir := t.TempDir()
+	repo := Repository{Provider: "github", Owner: "test", Name: "mod", URL: source}
+	if result := mirrorRepository(context.Background(), mirrorsDir, repo); !result.Succeeded() {
+		t.Fatalf("mirrorRepository() = %+v, want success", result)
+	}
+	server := &gitServer{
+		mirrorsDir:  mirrorsDir,
+		exports:     newMirrorExports(mirrorsDir, []Repository{repo}),
+		goproxy:     true,
+		lockTimeout: time.Second,
+	}
+	listener := httptest.NewServer(server)
+	t.Cleanup(listener.Close)
+	return listener.URL, source
+}
+
+func getGoProxy(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", url, err)
+	}
+	return response.StatusCode, body
+}
+
+func TestGoProxyEndpoints(t *testing.T) {
+	url, source := serveGoProxy(t)
+	head := runGit(t, source, "rev-parse", "HEAD")
+	t.Setenv("TZ", "UTC")
+	headTime := runGit(t, source, "show", "-s", "--format=%cd", "--date=format-local:%Y%m%d%H%M%S", "HEAD")
+	pseudo := "v1.1.0-rc.1.0." + headTime + "-" + head[:12]
+
+	tests := []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{"/github.com/test/mod/@v/list", 200, "v1.0.0\nv1.1.0-rc.1\n"},
+		{"/github.com/test/mod/@latest", 200, `"Version":"v1.0.0"`},
+		{"/github.com/test/mod/@v/v1.0.0.info", 200, `"Version":"v1.0.0"`},
+		{"/github.com/test/mod/@v/v1.0.0.mod", 200, "module github.com/test/mod\n\ngo 1.22\n"},
+		{"/github.com/test/mod/@v/main.info", 200, `"Version":"` + pseudo + `"`},
+		{"/github.com/test/mod/@v/" + head[:12] + ".info", 200, `"Version":"` + pseudo + `"`},
+		{"/github.com/test/mod/@v/" + pseudo + ".info", 200, `"Version":"` + pseudo + `"`},
+		{"/github.com/test/mod/@v/" + pseudo + ".mod", 200, "module github.com/test/mod\n"},
+		{"/github.com/test/mod/@v/v1.0.0-20000101000000-" + head[:12] + ".info", 404, "does not match"},
+		{"/github.com/test/mod/@v/v1.2.0.info", 404, "no version"},
+		{"/github.com/test/mod/@v/v2.0.0.info", 404, "not a version"},
+		{"/github.com/test/mod/v2/@v/list", 200, "v2.0.0\n"},
+		{"/github.com/test/mod/v2/@v/v2.0.0.mod", 200, "module github.com/test/mod/v2"},
+		{"/github.com/test/mod/sub/@v/list", 200, "v0.1.0\n"},
+		{"/github.com/test/mod/sub/@latest", 200, `"Version":"v0.1.0"`},
+		{"/github.com/test/mod/internal/@latest", 404, "no go.mod"},
+		{"/github.com/!test/mod/@v/list", 200, "v1.0.0\n"},
+		{"/github.com/Test/mod/@v/list", 400, "Invalid module path"},
+		{"/github.com/test/missing/@v/list", 404, "Module not found"},
+		{"/github.com/test/mod/@v/--output=x.info", 404, "invalid revision"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			status, body := getGoProxy(t, url+tt.path)
+			if status != tt.status || !strings.Contains(string(body), tt.expected) {
+				t.Errorf("GET %s = %d %q, want %d with %q", tt.path, status, body, tt.status, tt.expected)
+			}
+		})
+	}
+
+	_, body := getGoProxy(t, url+"/github.com/test/mod/@v/v1.0.0.info")
+	var info goModuleInfo
+	if err := json.Unmarshal(body, &info); err != nil || info.Time.IsZero() {
+		t.Errorf(".info = %s, %v, want a version and time", body, err)
+	}
+}
+
+func TestGoProxyZip(t *testing.T) {
+	url, _ := serveGoProxy(t)
+
+	tests := []struct {
+		module   string
+		version  string
+		expected []string
+	}{
+		{"github.com/test/mod", "v1.0.0", []string{"LICENSE", "go.mod", "internal/.hg_archival.txt", "internal/testdata/x", "mod.go", "vendor/modules.txt"}},
+		{"github.com/test/mod/sub", "v0.1.0", []string{"LICENSE", "go.mod", "sub.go"}},
+		{"github.com/test/mod/v2", "v2.0.0", []string{"LICENSE", "go.mod", "mod.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.module, func(t *testing.T) {
+			status, body := getGoProxy(t, url+"/"+tt.module+"/@v/"+tt.version+".zip")
+			if status != http.StatusOK {
+				t.Fatalf("GET .zip = %d %s", status, body)
+			}
+			reader, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+			if err != nil {
+				t.Fatalf("Invalid zip: %v", err)
+			}
+			var names []string
+			for _, file := range reader.File {
+				names = append(names, strings.TrimPrefix(file.Name, tt.module+"@"+tt.version+"/"))
+			}
+			slices.Sort(names)
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("zip files = %v, want %v", names, tt.expected)
+			}
+		})
+	}
+}
+
+// TestGoProxyMatchesDirect downloads modules with the go command through the
+// proxy and straight from the repository, which must give the same checksums
+// for the mirrors to work with existing go.sum files
+func TestGoProxyMatchesDirect(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go not available")
+	}
+	url, source := serveGoProxy(t)
+
+	// The direct download of github.com/test/mod is sent to the source
+	gitConfig := filepath.Join(t.TempDir(), "gitconfig")
+	if err := os.WriteFile(gitConfig, []byte(formatClientConfig([]insteadOfRule{{base: source, insteadOf: []string{"https://github.com/test/mod"}}})), 0644); err != nil {
+		t.Fatalf("Failed to write git configuration: %v", err)
+	}
+
+	download := func(proxy string) []string {
+		t.Helper()
+		cmd := exec.Command(goTool, "mod", "download", "-json",
+			"github.com/test/mod@v1.0.0", "github.com/test/mod/sub@latest", "github.com/test/mod/v2@v2.0.0", "github.com/test/mod@main")
+		cmd.Dir = t.TempDir()
+		cmd.Env = append(os.Environ(), "GOPROXY="+proxy, "GOSUMDB=off", "GOFLAGS=-modcacherw", "GO111MODULE=on",
+			"GIT_CONFIG_GLOBAL="+gitConfig, "GOMODCACHE="+filepath.Join(t.TempDir(), "modcache"))
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("go mod download with GOPROXY=%s failed: %v\n%s", proxy, err, output)
+		}
+		return regexp.MustCompile(`"(Version|Sum|GoModSum)": "[^"]*"`).FindAllString(string(output), -1)
+	}
+
+	proxied, direct := download(url), download("direct")
+	if len(proxied) != 12 || !reflect.DeepEqual(proxied, direct) {
+		t.Errorf("proxied downloads = %v, want %v", proxied, direct)
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	ordered := []string{"v0.1.0", "v1.0.0-alpha", "v1.0.0-alpha.1", "v1.0.0-alpha.beta", "v1.0.0-beta.2", "v1.0.0-beta.11", "v1.0.0-rc.1", "v1.0.0", "v1.2.0", "v1.10.0", "v10.0.0"}
+	for i := 1; i < len(ordered); i++ {
+		if compareSemver(ordered[i-1], ordered[i]) >= 0 || compareSemver(ordered[i], ordered[i-1]) <= 0 {
+			t.Errorf("compareSemver() should order %s before %s", ordered[i-1], ordered[i])
+		}
+	}
+
+	for version, expected := range map[string]bool{
+		"v1.2.3": true, "v1.2.3-rc.1": true, "v1.2": false, "1.2.3": false, "v1.2.3+meta": false,
+		"v01.2.3": false, "v0.0.0-20191109021931-daa7c04131f5": false,
+	} {
+		if isSemver(version) != expected {
+			t.Errorf("isSemver(%q) = %v", version, !expected)
+		}
+	}
+}
+
+func TestGoModuleFiles(t *testing.T) {
+	var files []treeFile
+	for _, name := range []string{"go.mod", "a.go", "vendor/modules.txt", "vendor/x/x.go", "pkg/vendor/y.go", "pkg/vendor/z/z.go", "nested/go.mod", "nested/n.go", "nested/deep/d.go"} {
+		files = append(files, treeFile{mode: "100644", path: name})
+	}
+	files = append(files, treeFile{mode: "120000", path: "link"}, treeFile{mode: "160000", path: "submodule"})
+
+	var names []string
+	for _, file := range goModuleFiles(files) {
+		names = append(names, file.path)
+	}
+	// pkg/vendor/y.go is excluded by the offset quirk of the go command
+	expected := []string{"go.mod", "a.go", "vendor/modules.txt"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("goModuleFiles() = %v, want %v", names, expected)
+	}
+}
+
+func TestUnescapeModulePath(t *testing.T) {
+	for escaped, expected := range map[string]string{
+		"github.com/!azure/azure-sdk": "github.com/Azure/azure-sdk",
+		"v1.0.0-!r!c1":                "v1.0.0-RC1",
+		"github.com/Azure/x":          "",
+		"github.com/!":                "",
+	} {
+		if path, ok := unescapeModulePath(escaped); path != expected || ok != (expected != "") {
+			t.Errorf("unescapeModulePath(%q) = %q, %v, want %q", escaped, path, ok, expected)
+		}
+	}
+}
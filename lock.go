@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Lock files live in the mirrors directory, hidden from status and from the
+// cleanup of staging directories: one for the whole directory, held by sync,
+// and one per repository under .locks, held by anything touching a mirror
+const (
+	mirrorsLockFile = ".making-mirrors.lock"
+	locksDir        = ".locks"
+)
+
+// lockPollInterval is how often a busy lock is tried again while waiting
+const lockPollInterval = 100 * time.Millisecond
+
+// errLocked matches the error of a lock held by another process
+var errLocked = errors.New("locked by another process")
+
+// errLockUnsupported is returned by lockFile on file systems without flock,
+// where the owner recorded in the lock file is all there is to go by
+var errLockUnsupported = errors.New("file locking not supported")
+
+// lockOwner is the process holding an exclusive lock, recorded in the lock
+// file so that others can tell who they wait for and detect stale locks
+type lockOwner struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Command string    `json:"command"`
+	Since   time.Time `json:"since"`
+}
+
+func (o *lockOwner) String() string {
+	return fmt.Sprintf("making-mirrors %s (pid %d on %s, since %s)", o.Command, o.PID, o.Host, o.Since.Local().Format(time.DateTime))
+}
+
+// stale reports whether the process that recorded itself as the owner is
+// gone. Only owners on this host can be checked; when flock works, holding
+// it proves that the recorded owner crashed without releasing the lock.
+func (o *lockOwner) stale(flocked bool) bool {
+	host, _ := os.Hostname()
+	if o.Host != host {
+		return false
+	}
+	return flocked || !processAlive(o.PID)
+}
+
+// lockedError is a lock held by another process, which is its owner when the
+// lock is exclusive
+type lockedError struct {
+	path  string
+	owner *lockOwner
+}
+
+func (e *lockedError) Error() string {
+	if e.owner == nil {
+		return fmt.Sprintf("%s is %v", e.path, errLocked)
+	}
+	host, _ := os.Hostname()
+	if e.owner.Host != host {
+		return fmt.Sprintf("%s is locked by %s; remove it if that process is no longer running", e.path, e.owner)
+	}
+	return fmt.Sprintf("%s is locked by %s", e.path, e.owner)
+}
+
+func (e *lockedError) Is(target error) bool {
+	return target == errLocked
+}
+
+// fileLock is an advisory lock held on a file
+type fileLock struct {
+	file      *os.File
+	exclusive bool
+}
+
+// tryLock takes the lock of path without waiting, recording this process as
+// its owner when it is exclusive. Shared locks can be held by many processes
+// at once, but not alongside an exclusive one.
+func tryLock(path string, exclusive bool, command string) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	flocked := true
+	switch err := lockFile(file, exclusive); {
+	case errors.Is(err, errLocked):
+		owner := readLockOwner(file)
+		file.Close()
+		return nil, &lockedError{path: path, owner: owner}
+	case errors.Is(err, errLockUnsupported):
+		flocked = false
+	case err != nil:
+		file.Close()
+		return nil, err
+	}
+
+	lock := &fileLock{file: file, exclusive: exclusive}
+	owner := readLockOwner(file)
+	if owner != nil {
+		if !owner.stale(flocked) {
+			lock.unlock()
+			return nil, &lockedError{path: path, owner: owner}
+		}
+		// A released flock is the normal end of a process that exited
+		// without clearing the owner
+		if exclusive && !flocked {
+			log.Printf("Warning: taking over the stale lock %s of %s", path, owner)
+		}
+	}
+	if !exclusive {
+		return lock, nil
+	}
+
+	host, _ := os.Hostname()
+	owner = &lockOwner{PID: os.Getpid(), Host: host, Command: command, Since: time.Now()}
+	if err := writeLockOwner(file, owner); err != nil {
+		lock.unlock()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// acquireLock takes the lock of path like tryLock, waiting for it while it is
+// held by another process until ctx is done. The error then tells who holds
+// it.
+func acquireLock(ctx context.Context, path string, exclusive bool, command string) (*fileLock, error) {
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		lock, err := tryLock(path, exclusive, command)
+		if !errors.Is(err, errLocked) {
+			return lock, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-ticker.C:
+		}
+	}
+}
+
+// lockMirrorsDir takes the exclusive lock of the mirrors directory, waiting up
+// to timeout for another run to release it
+func lockMirrorsDir(mirrorsDir string, timeout time.Duration, command string) (*fileLock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return acquireLock(ctx, filepath.Join(mirrorsDir, mirrorsLockFile), true, command)
+}
+
+// repositoryLockPath returns the lock file of the mirror of repo
+func repositoryLockPath(mirrorsDir string, repo Repository) string {
+	rel, err := filepath.Rel(mirrorsDir, repositoryDir(mirrorsDir, repo))
+	if err != nil {
+		rel = filepath.Join(repo.Provider, filepath.FromSlash(repo.Owner), repo.Name)
+	}
+	return filepath.Join(mirrorsDir, locksDir, rel+".lock")
+}
+
+// lockRepository takes the lock of the mirror of repo, waiting for it until
+// ctx is done. Syncs and garbage collections take it exclusively, readers
+// such as serve share it.
+func lockRepository(ctx context.Context, mirrorsDir string, repo Repository, exclusive bool, command string) (*fileLock, error) {
+	return acquireLock(ctx, repositoryLockPath(mirrorsDir, repo), exclusive, command)
+}
+
+// release clears the owner of an exclusive lock and releases it
+func (l *fileLock) release() {
+	if l.exclusive {
+		_ = l.file.Truncate(0)
+	}
+	l.unlock()
+}
+
+func (l *fileLock) unlock() {
+	_ = unlockFile(l.file)
+	l.file.Close()
+}
+
+// readLockOwner returns the owner recorded in a lock file, or nil when there
+// is none
+func readLockOwner(file *os.File) *lockOwner {
+	content, err := io.ReadAll(io.NewSectionReader(file, 0, 1<<16))
+	if err != nil || len(content) == 0 {
+		return nil
+	}
+	var owner lockOwner
+	if err := json.Unmarshal(content, &owner); err != nil || owner.PID == 0 {
+		return nil
+	}
+	return &owner
+}
+
+func writeLockOwner(file *os.File, owner *lockOwner) error {
+	content, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(append(content, '\n'), 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
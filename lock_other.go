@@ -0,0 +1,21 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package main
+
+import "os"
+
+// lockFile leaves locking to the owner recorded in the lock file, on systems
+// without flock
+func lockFile(file *os.File, exclusive bool) error {
+	return errLockUnsupported
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
+
+// processAlive cannot tell on these systems, so every process is assumed to
+// be running and only the owner's own host can release a stale lock by hand
+func processAlive(pid int) bool {
+	return true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTryLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirrors", mirrorsLockFile)
+
+	lock, err := tryLock(path, true, "sync")
+	if err != nil {
+		t.Fatalf("tryLock() unexpected error: %v", err)
+	}
+	_, err = tryLock(path, true, "sync")
+	if !errors.Is(err, errLocked) || !strings.Contains(err.Error(), fmt.Sprintf("making-mirrors sync (pid %d", os.Getpid())) {
+		t.Errorf("second tryLock() error = %v, want locked by this process", err)
+	}
+	if _, err := tryLock(path, false, "serve"); !errors.Is(err, errLocked) {
+		t.Errorf("shared tryLock() of an exclusive lock error = %v, want locked", err)
+	}
+	lock.release()
+
+	// Shared locks are held together, but keep exclusive ones out
+	first, err := tryLock(path, false, "serve")
+	if err != nil {
+		t.Fatalf("shared tryLock() unexpected error: %v", err)
+	}
+	second, err := tryLock(path, false, "serve")
+	if err != nil {
+		t.Fatalf("second shared tryLock() unexpected error: %v", err)
+	}
+	if _, err := tryLock(path, true, "gc"); !errors.Is(err, errLocked) {
+		t.Errorf("exclusive tryLock() of a shared lock error = %v, want locked", err)
+	}
+	first.release()
+	second.release()
+
+	lock, err = tryLock(path, true, "gc")
+	if err != nil {
+		t.Fatalf("tryLock() after release unexpected error: %v", err)
+	}
+	lock.release()
+}
+
+func TestAcquireLockWaits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), mirrorsLockFile)
+	held, err := tryLock(path, true, "sync")
+	if err != nil {
+		t.Fatalf("tryLock() unexpected error: %v", err)
+	}
+
+	if _, err := lockMirrorsDir(filepath.Dir(path), 0, "sync"); !errors.Is(err, errLocked) {
+		t.Errorf("lockMirrorsDir() without waiting error = %v, want locked", err)
+	}
+
+	time.AfterFunc(200*time.Millisecond, held.release)
+	lock, err := lockMirrorsDir(filepath.Dir(path), 10*time.Second, "sync")
+	if err != nil {
+		t.Fatalf("lockMirrorsDir() should get the lock once released: %v", err)
+	}
+	lock.release()
+}
+
+func TestStaleLock(t *testing.T) {
+	host, _ := os.Hostname()
+	cmd := exec.Command("git", "--version")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("git not available: %v", err)
+	}
+	deadPID := cmd.Process.Pid
+
+	path := filepath.Join(t.TempDir(), mirrorsLockFile)
+	writeOwner := func(owner lockOwner) {
+		t.Helper()
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatalf("Failed to create lock file: %v", err)
+		}
+		defer file.Close()
+		if err := writeLockOwner(file, &owner); err != nil {
+			t.Fatalf("writeLockOwner() unexpected error: %v", err)
+		}
+	}
+
+	// Left behind by a crashed run on this host
+	writeOwner(lockOwner{PID: deadPID, Host: host, Command: "sync", Since: time.Now()})
+	lock, err := tryLock(path, true, "sync")
+	if err != nil {
+		t.Fatalf("tryLock() over a stale lock unexpected error: %v", err)
+	}
+	lock.release()
+
+	// Another host cannot be checked
+	writeOwner(lockOwner{PID: deadPID, Host: host + "-elsewhere", Command: "sync", Since: time.Now()})
+	if _, err := tryLock(path, true, "sync"); !errors.Is(err, errLocked) || !strings.Contains(err.Error(), "no longer running") {
+		t.Errorf("tryLock() over a lock of another host error = %v, want locked", err)
+	}
+
+	// Without flock, the owner's process tells
+	if !(&lockOwner{PID: deadPID, Host: host}).stale(false) {
+		t.Errorf("stale() of a dead process = false")
+	}
+	if (&lockOwner{PID: os.Getpid(), Host: host}).stale(false) {
+		t.Errorf("stale() of a running process = true")
+	}
+}
+
+func TestMirrorRepositoryWaitsForLock(t *testing.T) {
+	source := createSourceRepository(t)
+	mirrorsDir := t.TempDir()
+	repo := Repository{Provider: "local", Owner: "test", Name: "source", URL: source}
+
+	held, err := tryLock(repositoryLockPath(mirrorsDir, repo), false, "serve")
+	if err != nil {
+		t.Fatalf("tryLock() unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if result := mirrorRepository(ctx, mirrorsDir, repo); result.Category != categoryTimeout || !errors.Is(result.Err, errLocked) {
+		t.Errorf("mirrorRepository() of a locked repository = %+v, want a lock timeout", result)
+	}
+
+	time.AfterFunc(200*time.Millisecond, held.release)
+	if result := mirrorRepository(context.Background(), mirrorsDir, repo); result.Action != resultCloned {
+		t.Errorf("mirrorRepository() once unlocked = %+v, want a clone", result)
+	}
+}
+
+func TestGCRepository(t *testing.T) {
+	source := createSourceRepository(t)
+	mirrorsDir := t.TempDir()
+	repo := Repository{Provider: "local", Owner: "test", Name: "source", URL: source}
+	if result := mirrorRepository(context.Background(), mirrorsDir, repo); !result.Succeeded() {
+		t.Fatalf("mirrorRepository() = %+v, want success", result)
+	}
+
+	if _, after, err := gcRepository(context.Background(), mirrorsDir, repo, false, 0); err != nil || after == 0 {
+		t.Errorf("gcRepository() = %d, %v, want packed objects", after, err)
+	}
+
+	held, err := tryLock(repositoryLockPath(mirrorsDir, repo), true, "sync")
+	if err != nil {
+		t.Fatalf("tryLock() unexpected error: %v", err)
+	}
+	defer held.release()
+	if _, _, err := gcRepository(context.Background(), mirrorsDir, repo, false, 0); !errors.Is(err, errLocked) {
+		t.Errorf("gcRepository() during a sync error = %v, want locked", err)
+	}
+}
@@ -6,14 +6,32 @@
 //
 // Usage:
 //
-//	making-mirrors [flags]
+//	making-mirrors [command] [flags]
 //
-// Flags:
+// Commands:
+//
+//	sync          Clone or update the repositories of the registry (default)
+//	add           Add a repository to the registry
+//	remove        Remove a repository from the registry
+//	list          List the repositories of the registry
+//	status        Compare the mirrors on disk with the registry
+//	gc            Pack and prune the mirrors
+//	serve         Serve the mirrors read-only over HTTP
+//	client-config Print the git configuration that redirects clones to the mirrors
+//	validate      Check the registry for errors
+//	convert       Convert a registry between the text and JSON formats
+//	import-stars  Add the repositories starred by a user to the registry
+//
+// Sync flags:
 //
 //	-input string
-//	  	Path to the registry CSV file (default "$HOME/Code/mirrors/registry.txt")
+//	  	Path to the registry file or directory (default "$HOME/Code/mirrors/registry.txt")
 //	-output string
 //	  	Directory to store mirrors (default "$HOME/Code/mirrors")
+//	-config string
+//	  	Path to the configuration file (default "$HOME/Code/mirrors/config.json")
+//	-strict
+//	  	Fail when registry entries share a mirror directory
 //
 // The registry file should contain repository information in a supported format,
 // and the tool will create bare Git mirrors in the specified output directory.
@@ -27,16 +45,22 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Package metadata and constants
@@ -64,6 +88,9 @@ const (
 
 	// DefaultMirrorsDir is the default directory for storing mirrors
 	DefaultMirrorsDir = "$HOME/Code/mirrors"
+
+	// DefaultConfigFile is the default path for the configuration file
+	DefaultConfigFile = "$HOME/Code/mirrors/config.json"
 )
 
 // BuildInfo contains build-time information
@@ -74,23 +101,120 @@ type BuildInfo struct {
 	GoVersion string
 }
 
+// Repository describes a single repository to be mirrored. Owner is the
+// namespace path of the repository, which is a single user or organization for
+// most providers and may be a slash-separated group path (group/subgroup) for
+// providers with nested namespaces. Options is only set for entries of a
+// structured registry that carry per-repository settings.
 type Repository struct {
 	Provider string
 	Owner    string
 	Name     string
 	URL      string
+	Options  *RepositoryOptions
 }
 
 func main() {
-	fmt.Printf("%s v%s\n", AppName, AppVersion)
-	fmt.Println(AppDescription)
-	fmt.Println("===")
+	// Without a command, or with only flags, the registry is synced as in
+	// earlier versions
+	command, args := "sync", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "sync":
+		runSync(args)
+	case "add":
+		runAdd(args)
+	case "remove":
+		runRemove(args)
+	case "list":
+		runList(args)
+	case "status":
+		runStatus(args)
+	case "gc":
+		runGC(args)
+	case "serve":
+		runServe(args)
+	case "client-config":
+		runClientConfig(args)
+	case "validate":
+		runValidate(args)
+	case "convert":
+		runConvert(args)
+	case "import-stars":
+		runImportStars(args)
+	case "help":
+		printUsage(os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", command)
+		printUsage(os.Stderr)
+		os.Exit(exitConfigError)
+	}
+}
+
+// printUsage prints the list of commands
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [command] [flags]\n\n", AppName)
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, "  sync          Clone or update the repositories of the registry (default)")
+	fmt.Fprintln(w, "  add           Add a repository to the registry")
+	fmt.Fprintln(w, "  remove        Remove a repository from the registry")
+	fmt.Fprintln(w, "  list          List the repositories of the registry")
+	fmt.Fprintln(w, "  status        Compare the mirrors on disk with the registry")
+	fmt.Fprintln(w, "  gc            Pack and prune the mirrors")
+	fmt.Fprintln(w, "  serve         Serve the mirrors read-only over HTTP")
+	fmt.Fprintln(w, "  client-config Print the git configuration that redirects clones to the mirrors")
+	fmt.Fprintln(w, "  validate      Check the registry for errors")
+	fmt.Fprintln(w, "  convert       Convert a registry between the text and JSON formats")
+	fmt.Fprintln(w, "  import-stars  Add the repositories starred by a user to the registry")
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command.\n", AppName)
+}
 
-	// Define CLI flags
-	var registryFile = flag.String("input", DefaultRegistryFile, "Path to the registry CSV file")
-	var mirrorsDir = flag.String("output", DefaultMirrorsDir, "Directory to store mirrors")
-	var version = flag.Bool("version", false, "Show version information")
-	flag.Parse()
+// runSync implements the sync command, which clones or updates every
+// repository of the registry
+func runSync(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	common := addRegistryFlags(flags)
+	common.addMirrorsFlag(flags)
+	filter := addFilterFlags(flags)
+	var strict = flags.Bool("strict", false, "Fail when registry entries share a mirror directory")
+	var failOn failureThreshold
+	flags.Var(&failOn, "fail-on", "Failures that fail the run: 'any', or a percentage of the repositories such as '10%'")
+	var maxParseErrors = flags.Int("max-parse-errors", -1, "Invalid registry entries tolerated before failing the run (-1 for no limit)")
+	var dryRun = flags.Bool("dry-run", false, "Print the planned action of every repository without running git or creating directories")
+	var reportFormat = flags.String("report-format", "", "Write a run report: json, ndjson or junit")
+	var reportFile = flags.String("report-file", "", "Path of the run report (default standard output, with the progress output on standard error)")
+	flags.IntVar(&defaultRetryPolicy.Retries, "retries", defaultRetryPolicy.Retries, "Retries of a clone or update failing with a transient network or server error")
+	flags.DurationVar(&defaultRetryPolicy.Delay, "retry-delay", defaultRetryPolicy.Delay, "Base delay between retries, doubled after each attempt")
+	var lockTimeout = flags.Duration("lock-timeout", 0, "How long to wait for another run on the same output directory to finish (0 to exit at once)")
+	var timeout = flags.Duration("timeout", 0, "Deadline of the whole run, after which the remaining repositories fail (0 for none)")
+	flags.DurationVar(&defaultRepositoryTimeout, "repo-timeout", defaultRepositoryTimeout, "Timeout of the sync of each repository, retries included (0 for none)")
+	flags.DurationVar(&stallTimeout, "stall-timeout", stallTimeout, "Kill git when it receives no data for this long (0 to disable)")
+	var version = flags.Bool("version", false, "Show version information")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s sync [flags] [provider:owner/name ...]\n\n", AppName)
+		fmt.Fprintln(flags.Output(), "Clones or updates the repositories of the registry, or only the selected ones.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		exitf(exitConfigError, "Failed to parse arguments: %v", err)
+	}
+	for _, selector := range flags.Args() {
+		if err := filter.addMatch(selector); err != nil {
+			exitf(exitConfigError, "Failed to parse arguments: %v", err)
+		}
+	}
+	if defaultRetryPolicy.Retries < 0 || defaultRetryPolicy.Delay <= 0 {
+		exitf(exitConfigError, "Invalid retry policy: -retries must not be negative and -retry-delay must be positive")
+	}
+	if *timeout < 0 || defaultRepositoryTimeout < 0 || stallTimeout < 0 {
+		exitf(exitConfigError, "Invalid timeout: -timeout, -repo-timeout and -stall-timeout must not be negative")
+	}
+	if *reportFormat != "" && !slices.Contains(reportFormats, *reportFormat) {
+		exitf(exitConfigError, "Unsupported report format: %s (expected %s)", *reportFormat, strings.Join(reportFormats, ", "))
+	}
 
 	// Handle version flag
 	if *version {
@@ -101,42 +225,97 @@ func main() {
 		return
 	}
 
-	// Use the CLI flag values (with defaults if not provided)
-	finalMirrorsDir := *mirrorsDir
-	finalRegistryFile := *registryFile
+	// A report written to standard output moves the progress output away
+	var out io.Writer = os.Stdout
+	if *reportFormat != "" && (*reportFile == "" || *reportFile == "-") {
+		out = os.Stderr
+	}
 
-	// Expand environment variables and tilde (~) to full paths
-	finalMirrorsDir = expandPath(finalMirrorsDir)
-	fmt.Printf("Output directory: %s\n", finalMirrorsDir)
-	finalRegistryFile = expandPath(finalRegistryFile)
-	fmt.Printf("Registry file: %s\n", finalRegistryFile)
+	fmt.Fprintf(out, "%s v%s\n", AppName, AppVersion)
+	fmt.Fprintln(out, AppDescription)
+	fmt.Fprintln(out, "===")
+
+	// Expand environment variables and tilde (~) to full paths, and load
+	// user-defined providers and credentials profiles
+	finalRegistryFile, finalMirrorsDir := common.load()
+	fmt.Fprintf(out, "Output directory: %s\n", finalMirrorsDir)
+	fmt.Fprintf(out, "Registry file: %s\n", finalRegistryFile)
+
+	if *dryRun {
+		plan, err := planSync(finalRegistryFile, finalMirrorsDir, filter, *strict)
+		if err != nil {
+			exitf(exitRegistryError, "Failed to read registry: %v", err)
+		}
+		fmt.Fprintln(out)
+		if err := writeSyncPlan(out, plan); err != nil {
+			exitf(exitConfigError, "Failed to write plan: %v", err)
+		}
+		if plan.failed(*strict, *maxParseErrors) {
+			exitf(exitRegistryError, "Failed to read registry: invalid or duplicate entries")
+		}
+		return
+	}
 
 	// Create mirrors directory if it doesn't exist
 	if err := os.MkdirAll(finalMirrorsDir, 0755); err != nil {
-		log.Fatalf("Failed to create mirrors directory: %v", err)
+		exitf(exitConfigError, "Failed to create mirrors directory: %v", err)
+	}
+
+	// Keep overlapping runs out of the mirrors directory
+	lock, err := lockMirrorsDir(finalMirrorsDir, *lockTimeout, "sync")
+	if errors.Is(err, errLocked) {
+		exitf(exitLocked, "Another run is in progress: %v", err)
+	} else if err != nil {
+		exitf(exitConfigError, "Failed to lock mirrors directory: %v", err)
+	}
+
+	// Remove the partial clones of earlier runs that crashed or were killed
+	removed, err := cleanStagingDirs(finalMirrorsDir)
+	if err != nil {
+		log.Printf("Warning: failed to clean up staging directories: %v", err)
+	}
+	for _, dir := range removed {
+		fmt.Fprintf(out, "Removed leftover staging directory: %s\n", dir)
 	}
 
 	// Read repositories from registry file
-	repos, err := readRegistry(finalRegistryFile)
+	repos, problems, err := loadRegistryProblems(finalRegistryFile, *strict)
 	if err != nil {
-		log.Fatalf("Failed to read registry: %v", err)
+		exitf(exitRegistryError, "Failed to read registry: %v", err)
+	}
+	if *maxParseErrors >= 0 && len(problems) > *maxParseErrors {
+		exitf(exitRegistryError, "Failed to read registry: %d invalid entries, at most %d allowed", len(problems), *maxParseErrors)
+	}
+
+	if !filter.empty() {
+		selected := filter.apply(repos)
+		fmt.Fprintf(out, "Selected %d of %d repositories\n", len(selected), len(repos))
+		repos = selected
 	}
 
-	fmt.Printf("Found %d repositories to mirror\n", len(repos))
+	fmt.Fprintf(out, "Found %d repositories to mirror\n", len(repos))
 
 	// Set up worker pool with all available CPU cores
 	numWorkers := runtime.NumCPU()
-	fmt.Printf("Using %d workers (CPU cores)\n", numWorkers)
+	fmt.Fprintf(out, "Using %d workers (CPU cores)\n", numWorkers)
 
 	// Create channels for work distribution
 	repoChan := make(chan Repository, len(repos))
-	resultChan := make(chan string, len(repos))
+	resultChan := make(chan Result, len(repos))
+
+	// Stop the workers on SIGINT, SIGTERM or the run deadline, still
+	// reporting every repository
+	ctx, stop := notifyContext(context.Background())
+	defer stop()
+	ctx, cancel := withRunDeadline(ctx, *timeout)
+	defer cancel()
 
 	// Start workers
+	started := time.Now()
 	var wg sync.WaitGroup
 	for i := 0; i < numWorkers; i++ {
 		wg.Add(1)
-		go worker(finalMirrorsDir, repoChan, resultChan, &wg)
+		go worker(ctx, finalMirrorsDir, repoChan, resultChan, &wg)
 	}
 
 	// Send repositories to workers
@@ -154,16 +333,132 @@ func main() {
 	}()
 
 	// Collect results from workers
-	fmt.Println("\nMirroring repositories...")
-	successCount := 0
+	fmt.Fprintln(out, "\nMirroring repositories...")
+	var results []Result
 	for result := range resultChan {
-		fmt.Println(result)
-		if strings.Contains(result, "✓") {
-			successCount++
+		fmt.Fprintln(out, result)
+		results = append(results, result)
+	}
+
+	lock.release()
+
+	summary := summarizeResults(results, started)
+	if ctx.Err() != nil {
+		fmt.Fprintf(out, "\nStopped: %v\n", context.Cause(ctx))
+	}
+	fmt.Fprintf(out, "\nCompleted! Successfully mirrored %d/%d repositories\n", summary.Succeeded, len(repos))
+
+	if *reportFormat != "" {
+		if err := saveReport(expandPath(*reportFile), *reportFormat, results, summary); err != nil {
+			exitf(exitConfigError, "Failed to write report: %v", err)
+		}
+	}
+
+	if errors.Is(context.Cause(ctx), context.Canceled) {
+		os.Exit(exitInterrupted)
+	}
+	if code := syncExitCode(summary, failOn); code != exitSuccess {
+		os.Exit(code)
+	}
+}
+
+// saveReport writes a run report to filename, or to standard output when it
+// is empty or "-"
+func saveReport(filename, format string, results []Result, summary reportSummary) error {
+	if filename == "" || filename == "-" {
+		return writeReport(os.Stdout, format, results, summary)
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := writeReport(file, format, results, summary); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// runConvert implements the convert command, which rewrites a registry file
+// in the format given by the extension of the output file
+func runConvert(args []string) {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s convert <input> <output>\n\n", AppName)
+		fmt.Fprintln(flags.Output(), "Converts between the plain-text (.txt) and structured (.json) registry formats.")
+	}
+	if err := flags.Parse(args); err != nil {
+		exitf(exitConfigError, "Failed to parse arguments: %v", err)
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	input := expandPath(flags.Arg(0))
+	output := expandPath(flags.Arg(1))
+	count, err := convertRegistry(input, output)
+	if err != nil {
+		exitf(exitRegistryError, "Failed to convert registry: %v", err)
+	}
+
+	fmt.Printf("Converted %d entries from %s to %s\n", count, input, output)
+}
+
+// runImportStars implements the import-stars command, which appends the
+// repositories starred by a user to the registry file
+func runImportStars(args []string) {
+	flags := flag.NewFlagSet("import-stars", flag.ExitOnError)
+	registryFile := flags.String("input", DefaultRegistryFile, "Path to the registry file to append to")
+	configFile := flags.String("config", DefaultConfigFile, "Path to the configuration file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import-stars [flags] <provider>:<user>\n\n", AppName)
+		fmt.Fprintln(flags.Output(), "Appends the repositories starred by a GitHub or Gitea user to the registry.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		exitf(exitConfigError, "Failed to parse arguments: %v", err)
+	}
+	providerName, user, found := strings.Cut(flags.Arg(0), ":")
+	if flags.NArg() != 1 || !found || providerName == "" || user == "" {
+		flags.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	loadConfigFile(*configFile)
+
+	if _, ok := providers[providerName]; !ok {
+		exitf(exitConfigError, "Unsupported provider: %s", providerName)
+	}
+
+	finalRegistryFile := expandPath(*registryFile)
+	added, skipped, err := importStars(finalRegistryFile, providerName, user)
+	if errors.Is(err, errListStars) {
+		exitf(exitTotalFailure, "Failed to import stars: %v", err)
+	} else if err != nil {
+		exitf(exitRegistryError, "Failed to import stars: %v", err)
+	}
+
+	for _, line := range added {
+		fmt.Printf("+ %s\n", line)
+	}
+	fmt.Printf("Added %d repositories to %s (%d already present)\n", len(added), finalRegistryFile, skipped)
+}
+
+// loadConfigFile loads user-defined providers and credentials profiles. The
+// default configuration file is optional.
+func loadConfigFile(configFile string) {
+	config, err := loadConfig(expandPath(configFile))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) || configFile != DefaultConfigFile {
+			exitf(exitConfigError, "Failed to load configuration: %v", err)
 		}
+		return
 	}
 
-	fmt.Printf("\nCompleted! Successfully mirrored %d/%d repositories\n", successCount, len(repos))
+	registerProviders(config.Providers)
+	credentialProfiles = config.Credentials
 }
 
 // expandPath expands environment variables and tilde (~) in file paths
@@ -175,7 +470,7 @@ func expandPath(path string) string {
 	if strings.HasPrefix(path, "~/") {
 		homeDir, err := os.UserHomeDir()
 		if err != nil {
-			log.Fatalf("Failed to get home directory: %v", err)
+			exitf(exitConfigError, "Failed to get home directory: %v", err)
 		}
 		path = filepath.Join(homeDir, path[2:])
 	}
@@ -183,43 +478,76 @@ func expandPath(path string) string {
 	return path
 }
 
+// readRegistry reads the repositories listed in a registry file, following
+// its include directives. A directory is read as the merge of every registry
+// file it contains. Entries sharing a mirror directory with an earlier entry
+// are skipped with a warning.
 func readRegistry(filename string) ([]Repository, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open %s: %v", filename, err)
+	return loadRegistry(filename, false)
+}
+
+// loadRegistry reads a registry like readRegistry. In strict mode, entries
+// sharing a mirror directory fail the whole read instead of being skipped.
+func loadRegistry(filename string, strict bool) ([]Repository, error) {
+	repos, _, err := loadRegistryProblems(filename, strict)
+	return repos, err
+}
+
+// loadRegistryProblems reads a registry like loadRegistry, and also returns
+// the invalid entries that were logged and skipped
+func loadRegistryProblems(filename string, strict bool) ([]Repository, []registryProblem, error) {
+	loader := &registryLoader{}
+	if err := loader.load(filename); err != nil {
+		return nil, nil, err
 	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			log.Printf("Warning: failed to close file: %v", err)
-		}
-	}()
 
-	var repos []Repository
-	scanner := bufio.NewScanner(file)
+	for _, problem := range loader.problems {
+		log.Printf("Warning: %s: Failed to parse line '%s': %s", problem.location(), problem.Entry, problem.Message)
+	}
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue // Skip empty lines and comments
+	entries, duplicates := dedupeRepositories(loader.repositories())
+	if len(duplicates) > 0 {
+		if strict {
+			var messages []string
+			for _, duplicate := range duplicates {
+				messages = append(messages, duplicate.String())
+			}
+			return nil, loader.problems, fmt.Errorf("duplicate entries:\n  %s", strings.Join(messages, "\n  "))
 		}
-
-		repo, err := parseRepositoryLine(line)
-		if err != nil {
-			log.Printf("Warning: Failed to parse line '%s': %v", line, err)
-			continue
+		for _, duplicate := range duplicates {
+			log.Printf("Warning: %s, skipping", duplicate)
 		}
-
-		repos = append(repos, repo)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading file: %v", err)
+	var repos []Repository
+	for _, entry := range entries {
+		repos = append(repos, entry.Repository)
 	}
+	return repos, loader.problems, nil
+}
+
+// syntaxError is a registry line parse error, located at a byte offset of
+// the line
+type syntaxError struct {
+	Offset int
+	Err    error
+}
 
-	return repos, nil
+func (e *syntaxError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *syntaxError) Unwrap() error {
+	return e.Err
 }
 
 func parseRepositoryLine(line string) (Repository, error) {
+	// Full clone URLs are recognized before the short format, since both
+	// "https://host/..." and "git@host:owner/repo" contain a colon
+	if isCloneURL(line) {
+		return parseRepositoryURL(line)
+	}
+
 	parts := strings.SplitN(line, ":", 2)
 	if len(parts) != 2 {
 		return Repository{}, fmt.Errorf("invalid format: expected 'provider:owner/repo.git'")
@@ -228,131 +556,412 @@ func parseRepositoryLine(line string) (Repository, error) {
 	provider := parts[0]
 	repoPath := strings.TrimSuffix(parts[1], ".git")
 
-	pathParts := strings.Split(repoPath, "/")
-	if len(pathParts) != 2 {
-		return Repository{}, fmt.Errorf("invalid repository path: expected 'owner/repo'")
-	}
-
-	owner := pathParts[0]
-	name := pathParts[1]
-
-	var url string
-	switch provider {
-	case "github":
-		url = fmt.Sprintf("https://github.com/%s/%s.git", owner, name)
-	case "gitlab":
-		url = fmt.Sprintf("https://gitlab.com/%s/%s.git", owner, name)
-	case "bitbucket":
-		url = fmt.Sprintf("https://bitbucket.org/%s/%s.git", owner, name)
-	case "gitea":
-		url = fmt.Sprintf("https://gitea.com/%s/%s.git", owner, name)
-	case "codecommit":
-		awsParts := strings.Split(owner, "-")
-		if len(awsParts) == 2 {
-			region := awsParts[1]
-			url = fmt.Sprintf("https://git-codecommit.%s.amazonaws.com/v1/repos/%s", region, name)
-		} else {
-			url = fmt.Sprintf("https://git-codecommit.%s.amazonaws.com/v1/repos/%s", owner, name)
-		}
-	case "azure":
-		url = fmt.Sprintf("https://dev.azure.com/%s/%s/_git/%s", owner, name, name)
-	default:
+	p, ok := providers[provider]
+	if !ok {
 		return Repository{}, fmt.Errorf("unsupported provider: %s", provider)
 	}
 
+	owner, name, err := splitRepositoryPath(repoPath, maxNamespaceDepth(provider))
+	if err != nil {
+		return Repository{}, &syntaxError{Offset: len(provider) + 1, Err: err}
+	}
+	owner = azureProjectOwner(p, owner, name)
+
+	return Repository{
+		Provider: provider,
+		Owner:    owner,
+		Name:     name,
+		URL:      p.cloneURL(owner, name),
+	}, nil
+}
+
+// isCloneURL reports whether line is a full clone URL (scheme://... or the
+// scp-like user@host:path syntax) rather than a provider:owner/repo entry
+func isCloneURL(line string) bool {
+	if strings.Contains(line, "://") {
+		return true
+	}
+	at := strings.Index(line, "@")
+	colon := strings.Index(line, ":")
+	return at > 0 && colon > at
+}
+
+// parseRepositoryURL parses a full clone URL such as
+// https://git.example.com/team/tool.git, git@github.com:org/repo.git or
+// ssh://host:2222/x/y.git. The provider is the short name of a known host
+// or the host name itself.
+func parseRepositoryURL(rawURL string) (Repository, error) {
+	var host, repoPath string
+
+	if strings.Contains(rawURL, "://") {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			// The error of url.Parse quotes the URL, with its credentials
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			return Repository{}, fmt.Errorf("invalid URL: %v", err)
+		}
+		switch u.Scheme {
+		case "https", "http", "ssh", "git":
+		default:
+			return Repository{}, fmt.Errorf("unsupported URL scheme: %s", u.Scheme)
+		}
+		host = u.Hostname()
+		repoPath = u.Path
+	} else {
+		// scp-like syntax: [user@]host:path
+		hostPart, pathPart, _ := strings.Cut(rawURL, ":")
+		host = hostPart[strings.Index(hostPart, "@")+1:]
+		repoPath = pathPart
+	}
+
+	if host == "" {
+		return Repository{}, fmt.Errorf("invalid URL: missing host")
+	}
+	if !isDirName(host) {
+		return Repository{}, fmt.Errorf("invalid URL: invalid host %q", host)
+	}
+
+	host = strings.ToLower(host)
+	provider, ok := providerForHost(host)
+	if !ok {
+		provider = host
+	}
+
+	// Self-hosted servers may well be GitLab instances, so unknown hosts
+	// accept namespaces of any depth
+	maxDepth := maxNamespaceDepth(provider)
+	if !ok {
+		maxDepth = -1
+	}
+
+	repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+	if ok && providers[provider].Kind == "azure" {
+		// https://dev.azure.com/org/project/_git/repo
+		repoPath = strings.Replace(repoPath, "/_git/", "/", 1)
+	}
+	owner, name, err := splitRepositoryPath(repoPath, maxDepth)
+	if err != nil {
+		return Repository{}, err
+	}
+	if ok {
+		owner = azureProjectOwner(providers[provider], owner, name)
+	}
+
 	return Repository{
 		Provider: provider,
 		Owner:    owner,
 		Name:     name,
-		URL:      url,
+		URL:      rawURL,
 	}, nil
 }
 
-func worker(mirrorsDir string, repoChan <-chan Repository, resultChan chan<- string, wg *sync.WaitGroup) {
+// azureProjectOwner returns the owner of an Azure Repos repository named
+// org/project/project, which is the default repository of the project, as
+// org so that it shares the azure/org/project mirror directory of the
+// shorter org/project form
+func azureProjectOwner(p Provider, owner, name string) string {
+	if org, project, found := strings.Cut(owner, "/"); p.Kind == "azure" && found && project == name {
+		return org
+	}
+	return owner
+}
+
+// redactURL hides the credentials a clone URL may hold before it is shown
+// or reported: the password, and the user name of HTTP URLs, where it is
+// often a token. SSH user names like git@ are kept.
+func redactURL(rawURL string) string {
+	scheme, userinfo, hostPath, ok := cutUserinfo(rawURL)
+	if !ok {
+		return rawURL
+	}
+	if user, _, hasPassword := strings.Cut(userinfo, ":"); hasPassword {
+		userinfo = user + ":xxxxx"
+	} else if scheme == "http" || scheme == "https" {
+		userinfo = "xxxxx"
+	}
+	return scheme + "://" + userinfo + "@" + hostPath
+}
+
+// cutUserinfo splits a scheme://userinfo@host/path URL around its userinfo.
+// The URL is not parsed, so that malformed entries are split too.
+func cutUserinfo(rawURL string) (scheme, userinfo, hostPath string, ok bool) {
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return "", "", "", false
+	}
+	authority := rest
+	if end := strings.IndexAny(rest, "/?#"); end >= 0 {
+		authority = rest[:end]
+	}
+	at := strings.LastIndex(authority, "@")
+	if at < 0 {
+		return "", "", "", false
+	}
+	return scheme, rest[:at], rest[at+1:], true
+}
+
+// splitRepositoryPath splits "owner/repo" (or "group/subgroup/repo" when
+// maxDepth allows it) into the namespace path and the repository name
+func splitRepositoryPath(repoPath string, maxDepth int) (string, string, error) {
+	pathParts := strings.Split(repoPath, "/")
+	if len(pathParts) < 2 || (maxDepth >= 0 && len(pathParts)-1 > maxDepth) {
+		return "", "", fmt.Errorf("invalid repository path: expected 'owner/repo'")
+	}
+	for _, part := range pathParts {
+		if part == "" {
+			return "", "", fmt.Errorf("invalid repository path: empty path segment")
+		}
+		// Wildcards belong to owner patterns, which have no mirror of their
+		// own
+		if strings.ContainsAny(part, "*?[") {
+			return "", "", fmt.Errorf("invalid repository path: wildcard in %q, only owner patterns like provider:owner/* accept one", part)
+		}
+		// Segments become directories of the mirror, which must stay in
+		// the mirrors directory
+		if !isDirName(part) {
+			return "", "", fmt.Errorf("invalid repository path: %q segment", part)
+		}
+	}
+
+	last := len(pathParts) - 1
+	return strings.Join(pathParts[:last], "/"), pathParts[last], nil
+}
+
+func worker(ctx context.Context, mirrorsDir string, repoChan <-chan Repository, resultChan chan<- Result, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	for repo := range repoChan {
-		result := mirrorRepository(mirrorsDir, repo)
+		// Once the run is stopped, the remaining repositories are reported
+		// without being synced
+		if ctx.Err() != nil {
+			cause := context.Cause(ctx)
+			resultChan <- failedResult(repo, contextCategory(cause), fmt.Errorf("Not synced: %w", cause), "")
+			continue
+		}
+		result := mirrorRepository(ctx, mirrorsDir, repo)
 		resultChan <- result
 	}
 }
 
-func mirrorRepository(mirrorsDir string, repo Repository) string {
-	repoDir := filepath.Join(mirrorsDir, repo.Provider, repo.Owner, repo.Name)
+func mirrorRepository(ctx context.Context, mirrorsDir string, repo Repository) Result {
+	repoDir := repositoryDir(mirrorsDir, repo)
+	start := time.Now()
 
-	// Check if repository already exists (check for refs directory in bare repository)
-	if _, err := os.Stat(filepath.Join(repoDir, "refs")); err == nil {
-		// Repository exists, pull latest changes
-		return pullRepository(repoDir, repo)
-	} else {
-		// Repository doesn't exist, clone it
-		return cloneRepository(mirrorsDir, repo)
+	ctx, cancel := withRepositoryTimeout(ctx, repo)
+	defer cancel()
+
+	// Wait for a gc or the readers of the mirror to finish
+	lock, err := lockRepository(ctx, mirrorsDir, repo, true, "sync")
+	if err != nil {
+		category := categoryFilesystem
+		if errors.Is(err, errLocked) {
+			category = contextCategory(context.Cause(ctx))
+		}
+		return failedResult(repo, category, fmt.Errorf("Failed to lock repository: %w", err), "")
+	}
+	defer lock.release()
+
+	sizeBefore := objectsSize(repoDir)
+	action, synced := planMirror(repoDir, repo)
+	if action == actionSkip {
+		return Result{Repository: repo, Action: resultSkipped, Synced: synced}
+	}
+
+	// Transient failures are retried with an exponential backoff
+	policy := repositoryRetryPolicy(repo)
+	var result Result
+	for attempt := 1; ; attempt++ {
+		if action == actionUpdate {
+			// Repository exists, pull latest changes
+			result = pullRepository(ctx, repoDir, repo)
+		} else {
+			// Repository doesn't exist, clone it
+			result = cloneRepository(ctx, mirrorsDir, repo)
+		}
+		result.Attempts = attempt
+
+		if result.Succeeded() || result.Category != categoryTransient || attempt > policy.Retries {
+			break
+		}
+		delay := policy.backoff(attempt)
+		log.Printf("Warning: %s/%s: %v, retry %d of %d in %s", repo.Owner, repo.Name, result.Err, attempt, policy.Retries, delay.Round(time.Millisecond))
+		if !sleepContext(ctx, delay) {
+			break
+		}
+	}
+
+	if result.Succeeded() && repo.Options != nil && repo.Options.LFS {
+		if err := fetchLFS(ctx, repoDir, repo); err != nil {
+			category := categoryLFS
+			if ctx.Err() != nil {
+				category, err = contextCategory(context.Cause(ctx)), context.Cause(ctx)
+			}
+			result = failedResult(repo, category, fmt.Errorf("LFS fetch failed: %w", err), "")
+		}
+	}
+
+	result.Duration = time.Since(start)
+	if result.Succeeded() {
+		result.BytesReceived = max(objectsSize(repoDir)-sizeBefore, 0)
+	}
+
+	// A failed clone leaves no mirror to record its failure in
+	if mirrorExists(repoDir) {
+		if err := recordSyncResult(repoDir, result, time.Now()); err != nil {
+			log.Printf("Warning: failed to record sync result of %s/%s: %v", repo.Owner, repo.Name, err)
+		}
+	}
+
+	return result
+}
+
+// sleepContext waits for d, and reports false when ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Actions taken by a sync on a repository
+const (
+	actionClone  = "clone"
+	actionUpdate = "update"
+	actionSkip   = "skip"
+)
+
+// planMirror decides what mirrorRepository does with repo: clone it when
+// there is no mirror yet, update the existing mirror, or skip it when it was
+// synced more recently than its interval, in which case the last sync time is
+// returned as well. It only reads the mirror directory.
+func planMirror(repoDir string, repo Repository) (string, time.Time) {
+	if !mirrorExists(repoDir) {
+		return actionClone, time.Time{}
+	}
+	if repo.Options != nil && repo.Options.Interval > 0 {
+		if synced, ok := lastSyncTime(repoDir); ok && time.Since(synced) < repo.Options.Interval {
+			return actionSkip, synced
+		}
+	}
+	return actionUpdate, time.Time{}
+}
+
+// mirrorExists reports whether a bare mirror has been cloned into repoDir,
+// which is when it has a refs directory
+func mirrorExists(repoDir string) bool {
+	info, err := os.Stat(filepath.Join(repoDir, "refs"))
+	return err == nil && info.IsDir()
+}
+
+// repositoryDir returns the mirror directory of a repository, nesting one
+// directory per namespace segment: provider/group/subgroup/name. A custom
+// path from the structured registry takes precedence. Parsing rejects the
+// provider names, path segments and custom paths that would leave mirrorsDir.
+func repositoryDir(mirrorsDir string, repo Repository) string {
+	if repo.Options != nil && repo.Options.Path != "" {
+		return filepath.Join(mirrorsDir, filepath.FromSlash(repo.Options.Path))
 	}
+	return filepath.Join(mirrorsDir, repo.Provider, filepath.FromSlash(repo.Owner), repo.Name)
 }
 
-func cloneRepository(mirrorsDir string, repo Repository) string {
-	repoDir := filepath.Join(mirrorsDir, repo.Provider, repo.Owner, repo.Name)
+// isDirName reports whether name can be a single directory of a mirror path:
+// not . or .., without separators, and not a name reserved by the system
+func isDirName(name string) bool {
+	return name != "." && filepath.IsLocal(name) && filepath.Base(name) == name
+}
+
+func cloneRepository(ctx context.Context, mirrorsDir string, repo Repository) Result {
+	repoDir := repositoryDir(mirrorsDir, repo)
 
 	// Create parent directory
 	if err := os.MkdirAll(filepath.Dir(repoDir), 0755); err != nil {
-		return fmt.Sprintf("✗ %s/%s: Failed to create directory: %v", repo.Owner, repo.Name, err)
+		return failedResult(repo, categoryFilesystem, fmt.Errorf("Failed to create directory: %v", err), "")
+	}
+
+	// Clone into a staging directory, renamed into place once complete, so
+	// that a failed or killed clone never leaves a partial mirror behind for
+	// the next sync to update
+	stagingDir, err := createStagingDir(repoDir)
+	if err != nil {
+		return failedResult(repo, categoryFilesystem, fmt.Errorf("Failed to create directory: %v", err), "")
+	}
+	defer os.RemoveAll(stagingDir)
+
+	// A ref filter needs the fetch refspecs in place before the first fetch,
+	// which git clone does not allow
+	if repo.Options != nil && len(repo.Options.Refs) > 0 {
+		if err := initFilteredMirror(ctx, stagingDir, repo); err != nil {
+			return failedResult(repo, categoryGit, fmt.Errorf("Clone failed: %v", err), "")
+		}
+		stderr, err := runGitCommand(ctx, repo, stagingDir, "-C", stagingDir, "fetch", "--prune", "--progress", "origin")
+		if err != nil {
+			return gitFailedResult(repo, fmt.Errorf("Clone failed: %w", err), stderr)
+		}
+	} else {
+		stderr, err := runGitCommand(ctx, repo, stagingDir, "clone", "--mirror", "--progress", repo.URL, stagingDir)
+		if err != nil {
+			return gitFailedResult(repo, fmt.Errorf("Clone failed: %w", err), stderr)
+		}
 	}
 
-	// Clone the repository
-	cmd := exec.Command("git", "clone", "--mirror", repo.URL, repoDir)
-	if err := cmd.Run(); err != nil {
-		return fmt.Sprintf("✗ %s/%s: Clone failed: %v", repo.Owner, repo.Name, err)
+	if stderr, err := verifyMirror(ctx, stagingDir); err != nil {
+		result := gitFailedResult(repo, fmt.Errorf("Clone verification failed: %w", err), stderr)
+		if result.Category == categoryGit {
+			result.Category = categoryCorruption
+		}
+		return result
+	}
+	if err := publishMirror(stagingDir, repoDir); err != nil {
+		return failedResult(repo, categoryFilesystem, fmt.Errorf("Failed to move clone into place: %v", err), "")
 	}
 
-	return fmt.Sprintf("✓ %s/%s: Cloned successfully", repo.Owner, repo.Name)
+	result := Result{Repository: repo, Action: resultCloned}
+	if refs, err := exec.CommandContext(ctx, "git", "-C", repoDir, "show-ref").Output(); err == nil {
+		result.RefUpdates = diffRefs("", string(refs))
+		result.ChangedRefs = len(result.RefUpdates)
+	}
+	return result
 }
 
-func pullRepository(repoDir string, repo Repository) string {
+func pullRepository(ctx context.Context, repoDir string, repo Repository) Result {
 	// Get the current state of refs before update
-	beforeCmd := exec.Command("git", "-C", repoDir, "show-ref")
+	beforeCmd := exec.CommandContext(ctx, "git", "-C", repoDir, "show-ref")
 	beforeOutput, beforeErr := beforeCmd.Output()
 
-	// Perform remote update
-	cmd := exec.Command("git", "-C", repoDir, "remote", "update")
-	if err := cmd.Run(); err != nil {
-		return fmt.Sprintf("✗ %s/%s: Remote update failed: %v", repo.Owner, repo.Name, err)
+	// Apply the current ref filter, which may have changed in the registry
+	if repo.Options != nil && len(repo.Options.Refs) > 0 {
+		if err := setRefFilter(repoDir, repo.Options.Refs); err != nil {
+			return failedResult(repo, categoryGit, fmt.Errorf("Remote update failed: %v", err), "")
+		}
+	}
+
+	// Perform remote update. Unlike git remote update, git fetch --all can
+	// write progress, which tells a slow update from a stalled one.
+	stderr, err := runGitCommand(ctx, repo, repoDir, "-C", repoDir, "fetch", "--all", "--progress")
+	if err != nil {
+		return gitFailedResult(repo, fmt.Errorf("Remote update failed: %w", err), stderr)
 	}
 
 	// Get the state of refs after update
-	afterCmd := exec.Command("git", "-C", repoDir, "show-ref")
+	afterCmd := exec.CommandContext(ctx, "git", "-C", repoDir, "show-ref")
 	afterOutput, afterErr := afterCmd.Output()
 
 	// If we couldn't get refs info, assume update was successful
 	if beforeErr != nil || afterErr != nil {
-		return fmt.Sprintf("✓ %s/%s: Updated successfully", repo.Owner, repo.Name)
+		return Result{Repository: repo, Action: resultUpdated}
 	}
 
 	// Compare before and after refs to see if anything changed
-	beforeRefs := strings.TrimSpace(string(beforeOutput))
-	afterRefs := strings.TrimSpace(string(afterOutput))
-
-	if beforeRefs == afterRefs {
-		return fmt.Sprintf("✓ %s/%s: Already up to date", repo.Owner, repo.Name)
-	}
-
-	// Check if this might be a force push by looking for shortened ref lists
-	// (indicating some refs were updated/overwritten)
-	beforeLines := strings.Split(beforeRefs, "\n")
-	afterLines := strings.Split(afterRefs, "\n")
-
-	// If we have significantly different number of refs, it might be a complex update
-	if len(beforeLines) > 0 && len(afterLines) > 0 &&
-		abs(len(beforeLines)-len(afterLines)) > len(beforeLines)/10 {
-		return fmt.Sprintf("✓ %s/%s: Updated (significant changes detected)", repo.Owner, repo.Name)
-	}
-
-	return fmt.Sprintf("✓ %s/%s: Updated successfully", repo.Owner, repo.Name)
-}
-
-// Helper function to calculate absolute difference
-func abs(x int) int {
-	if x < 0 {
-		return -x
+	updates := diffRefs(string(beforeOutput), string(afterOutput))
+	if len(updates) == 0 {
+		return Result{Repository: repo, Action: resultUnchanged}
 	}
-	return x
+	return Result{Repository: repo, Action: resultUpdated, ChangedRefs: len(updates), RefUpdates: updates}
 }
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroup leaves cmd as it is where process groups are not
+// available, so only git itself is killed on cancellation
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killProcessGroup starts cmd in a process group of its own, and makes its
+// cancellation kill the whole group. Otherwise the transport helpers of git,
+// like git-remote-https, outlive a killed git and keep waiting on a stalled
+// connection. Being out of the foreground group of the terminal, git could
+// not prompt for credentials there, so it is told not to try.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.Env = append(cmd.Environ(), "GIT_TERMINAL_PROMPT=0")
+}
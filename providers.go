@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Provider describes a Git hosting service that registry entries refer to by
+// name, as in "github:golang/go" or "corp-gitlab:infra/terraform"
+type Provider struct {
+	// Kind is the hosting software: github, gitlab, gitea, bitbucket, azure,
+	// codecommit or generic. It decides how namespaces are laid out.
+	Kind string `json:"kind"`
+
+	// Host is the host name of the service, also used to recognize full URLs
+	Host string `json:"host,omitempty"`
+
+	// URL is an optional clone URL template. It may use {host}, {owner},
+	// {name} and {path} (owner/name), {org} and {project} for azure, and
+	// {region} for codecommit.
+	URL string `json:"url,omitempty"`
+
+	// Protocol picks the default URL template when URL is empty: https or ssh
+	Protocol string `json:"protocol,omitempty"`
+
+	// API is the base URL of the provider API, used to list repositories.
+	// Self-hosted GitHub, GitLab and Gitea servers default to their usual path.
+	API string `json:"api,omitempty"`
+
+	// TokenEnv names the environment variable holding an API token
+	TokenEnv string `json:"token_env,omitempty"`
+}
+
+// Credentials is a named profile that structured registry entries reference
+// to authenticate against private repositories
+type Credentials struct {
+	// Username is sent along with the token over HTTPS (default "git")
+	Username string `json:"username,omitempty"`
+
+	// TokenEnv names the environment variable holding the password or token,
+	// so that secrets are not stored in the configuration file
+	TokenEnv string `json:"token_env,omitempty"`
+
+	// SSHKey is the path to the private key used for SSH URLs
+	SSHKey string `json:"ssh_key,omitempty"`
+}
+
+// Config holds the settings read from the configuration file
+type Config struct {
+	Providers   map[string]Provider    `json:"providers"`
+	Credentials map[string]Credentials `json:"credentials"`
+}
+
+// providerKinds lists the supported kinds with the number of namespace
+// segments each accepts before the repository name (-1 for no limit)
+var providerKinds = map[string]int{
+	"github":     1,
+	"gitlab":     -1,
+	"gitea":      1,
+	"bitbucket":  1,
+	"azure":      2,
+	"codecommit": 1,
+	"generic":    -1,
+}
+
+// caseInsensitiveKinds lists the kinds whose owner and repository names
+// ignore case
+var caseInsensitiveKinds = map[string]bool{
+	"github":    true,
+	"gitlab":    true,
+	"gitea":     true,
+	"bitbucket": true,
+	"azure":     true,
+}
+
+// defaultURLTemplates holds the clone URL templates used when a provider does
+// not set its own, by kind and then by protocol. The empty kind is the fallback.
+var defaultURLTemplates = map[string]map[string]string{
+	"": {
+		"https": "https://{host}/{path}.git",
+		"ssh":   "git@{host}:{path}.git",
+	},
+	"azure": {
+		"https": "https://{host}/{org}/{project}/_git/{name}",
+		"ssh":   "git@ssh.{host}:v3/{org}/{project}/{name}",
+	},
+	"codecommit": {
+		"https": "https://git-codecommit.{region}.amazonaws.com/v1/repos/{name}",
+		"ssh":   "ssh://git-codecommit.{region}.amazonaws.com/v1/repos/{name}",
+	},
+}
+
+// defaultProviders returns the built-in providers
+func defaultProviders() map[string]Provider {
+	return map[string]Provider{
+		"github":     {Kind: "github", Host: "github.com", API: "https://api.github.com", TokenEnv: "GITHUB_TOKEN"},
+		"gitlab":     {Kind: "gitlab", Host: "gitlab.com", TokenEnv: "GITLAB_TOKEN"},
+		"bitbucket":  {Kind: "bitbucket", Host: "bitbucket.org", API: "https://api.bitbucket.org/2.0", TokenEnv: "BITBUCKET_TOKEN"},
+		"gitea":      {Kind: "gitea", Host: "gitea.com", TokenEnv: "GITEA_TOKEN"},
+		"codecommit": {Kind: "codecommit"},
+		"azure":      {Kind: "azure", Host: "dev.azure.com"},
+	}
+}
+
+// providers is the table registry entries are resolved against. It starts
+// with the built-in providers and is extended by the configuration file.
+var providers = defaultProviders()
+
+// credentialProfiles holds the credentials profiles of the configuration file
+var credentialProfiles = map[string]Credentials{}
+
+// loadConfig reads and validates a JSON configuration file
+func loadConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", filename, err)
+	}
+
+	for name, provider := range config.Providers {
+		if err := validateProvider(name, provider); err != nil {
+			return nil, fmt.Errorf("%s: provider %q: %v", filename, name, err)
+		}
+	}
+
+	for name, credentials := range config.Credentials {
+		if credentials.TokenEnv == "" && credentials.SSHKey == "" {
+			return nil, fmt.Errorf("%s: credentials %q: either token_env or ssh_key must be set", filename, name)
+		}
+	}
+
+	return &config, nil
+}
+
+// registerProviders adds providers to the table, replacing built-in
+// definitions with the same name
+func registerProviders(defined map[string]Provider) {
+	for name, provider := range defined {
+		providers[name] = provider
+	}
+}
+
+func validateProvider(name string, provider Provider) error {
+	// The name is the first directory of the mirrors of the provider
+	if !isDirName(name) || strings.ContainsAny(name, ":/@ \t") {
+		return fmt.Errorf("invalid name")
+	}
+	if _, ok := providerKinds[provider.Kind]; !ok {
+		return fmt.Errorf("unsupported kind: %q", provider.Kind)
+	}
+	switch provider.Protocol {
+	case "", "https", "ssh":
+	default:
+		return fmt.Errorf("unsupported protocol: %q", provider.Protocol)
+	}
+	if provider.URL == "" && provider.Host == "" && provider.Kind != "codecommit" {
+		return fmt.Errorf("either host or url must be set")
+	}
+	return nil
+}
+
+// maxNamespaceDepth returns how many namespace segments a provider accepts
+// before the repository name, or -1 when there is no limit
+func maxNamespaceDepth(provider string) int {
+	if p, ok := providers[provider]; ok {
+		return providerKinds[p.Kind]
+	}
+	return 1
+}
+
+// providerForHost returns the name of the provider serving host, so that a
+// full URL and its short form end up in the same mirror directory
+func providerForHost(host string) (string, bool) {
+	var names []string
+	for name, p := range providers {
+		if p.Host != "" && strings.EqualFold(p.Host, host) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+
+	// Pick deterministically if several providers share a host
+	sort.Strings(names)
+	return names[0], true
+}
+
+// cloneURL expands the provider's URL template for a repository
+func (p Provider) cloneURL(owner, name string) string {
+	template := p.URL
+	if template == "" {
+		protocol := p.Protocol
+		if protocol == "" {
+			protocol = "https"
+		}
+		templates, ok := defaultURLTemplates[p.Kind]
+		if !ok {
+			templates = defaultURLTemplates[""]
+		}
+		template = templates[protocol]
+	}
+
+	// azure:org/project/repo names the project explicitly, while the shorter
+	// azure:org/project form mirrors the project's default repository
+	org, project, found := strings.Cut(owner, "/")
+	if !found {
+		project = name
+	}
+
+	// CodeCommit entries name the region as the owner, and a two-part owner
+	// such as "account-region" uses its second part
+	region := owner
+	if awsParts := strings.Split(owner, "-"); len(awsParts) == 2 {
+		region = awsParts[1]
+	}
+
+	return strings.NewReplacer(
+		"{host}", p.Host,
+		"{owner}", owner,
+		"{name}", name,
+		"{path}", owner+"/"+name,
+		"{org}", org,
+		"{project}", project,
+		"{region}", region,
+	).Replace(template)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withProviders replaces the provider table for the duration of a test
+func withProviders(t *testing.T, defined map[string]Provider) {
+	t.Helper()
+	saved := providers
+	providers = defaultProviders()
+	registerProviders(defined)
+	t.Cleanup(func() { providers = saved })
+}
+
+func TestProviderCloneURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider Provider
+		owner    string
+		repo     string
+		expected string
+	}{
+		{
+			name:     "default https template",
+			provider: Provider{Kind: "gitlab", Host: "gitlab.corp.example"},
+			owner:    "infra",
+			repo:     "terraform",
+			expected: "https://gitlab.corp.example/infra/terraform.git",
+		},
+		{
+			name:     "default ssh template",
+			provider: Provider{Kind: "gitea", Host: "git.corp.example", Protocol: "ssh"},
+			owner:    "team",
+			repo:     "tool",
+			expected: "git@git.corp.example:team/tool.git",
+		},
+		{
+			name:     "custom template",
+			provider: Provider{Kind: "bitbucket", URL: "https://bitbucket.corp.example/scm/{owner}/{name}.git"},
+			owner:    "proj",
+			repo:     "service",
+			expected: "https://bitbucket.corp.example/scm/proj/service.git",
+		},
+		{
+			name:     "azure ssh template",
+			provider: Provider{Kind: "azure", Host: "dev.azure.com", Protocol: "ssh"},
+			owner:    "org/project",
+			repo:     "repo",
+			expected: "git@ssh.dev.azure.com:v3/org/project/repo",
+		},
+		{
+			name:     "codecommit region",
+			provider: Provider{Kind: "codecommit"},
+			owner:    "eu-west-1",
+			repo:     "repo",
+			expected: "https://git-codecommit.eu-west-1.amazonaws.com/v1/repos/repo",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tt.provider.cloneURL(tt.owner, tt.repo)
+			if result != tt.expected {
+				t.Errorf("cloneURL(%q, %q) = %q, want %q", tt.owner, tt.repo, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		expectError bool
+	}{
+		{
+			name: "valid providers",
+			content: `{"providers": {
+				"corp-gitlab": {"kind": "gitlab", "host": "gitlab.corp.example", "protocol": "ssh"},
+				"corp-gitea": {"kind": "gitea", "url": "https://git.corp.example/{path}.git"}
+			}}`,
+			expectError: false,
+		},
+		{
+			name:        "unknown kind",
+			content:     `{"providers": {"corp": {"kind": "sourceforge", "host": "example.com"}}}`,
+			expectError: true,
+		},
+		{
+			name:        "unknown protocol",
+			content:     `{"providers": {"corp": {"kind": "gitlab", "host": "example.com", "protocol": "ftp"}}}`,
+			expectError: true,
+		},
+		{
+			name:        "missing host and url",
+			content:     `{"providers": {"corp": {"kind": "gitlab"}}}`,
+			expectError: true,
+		},
+		{
+			name:        "invalid name",
+			content:     `{"providers": {"corp:lab": {"kind": "gitlab", "host": "example.com"}}}`,
+			expectError: true,
+		},
+		{
+			name:        "parent directory name",
+			content:     `{"providers": {"..": {"kind": "gitlab", "host": "example.com"}}}`,
+			expectError: true,
+		},
+		{
+			name:        "malformed json",
+			content:     `{"providers": `,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpFile := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(tmpFile, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+
+			_, err := loadConfig(tmpFile)
+			if tt.expectError && err == nil {
+				t.Errorf("loadConfig() expected error but got none")
+			}
+			if !tt.expectError && err != nil {
+				t.Errorf("loadConfig() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseRepositoryLineCustomProviders(t *testing.T) {
+	withProviders(t, map[string]Provider{
+		"corp-gitlab": {Kind: "gitlab", Host: "gitlab.corp.example", Protocol: "ssh"},
+		"github":      {Kind: "github", Host: "github.com", Protocol: "ssh"},
+	})
+
+	tests := []struct {
+		name     string
+		input    string
+		expected Repository
+	}{
+		{
+			name:  "user-defined provider",
+			input: "corp-gitlab:infra/terraform",
+			expected: Repository{
+				Provider: "corp-gitlab",
+				Owner:    "infra",
+				Name:     "terraform",
+				URL:      "git@gitlab.corp.example:infra/terraform.git",
+			},
+		},
+		{
+			name:  "user-defined provider with subgroups",
+			input: "corp-gitlab:infra/modules/network",
+			expected: Repository{
+				Provider: "corp-gitlab",
+				Owner:    "infra/modules",
+				Name:     "network",
+				URL:      "git@gitlab.corp.example:infra/modules/network.git",
+			},
+		},
+		{
+			name:  "URL on a user-defined host",
+			input: "https://gitlab.corp.example/infra/terraform.git",
+			expected: Repository{
+				Provider: "corp-gitlab",
+				Owner:    "infra",
+				Name:     "terraform",
+				URL:      "https://gitlab.corp.example/infra/terraform.git",
+			},
+		},
+		{
+			name:  "overridden built-in provider",
+			input: "github:golang/go",
+			expected: Repository{
+				Provider: "github",
+				Owner:    "golang",
+				Name:     "go",
+				URL:      "git@github.com:golang/go.git",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := parseRepositoryLine(tt.input)
+			if err != nil {
+				t.Fatalf("parseRepositoryLine(%q) unexpected error: %v", tt.input, err)
+			}
+			if result != tt.expected {
+				t.Errorf("parseRepositoryLine(%q) = %+v, want %+v", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
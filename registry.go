@@ -0,0 +1,724 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RepositoryOptions holds the per-repository settings that only the
+// structured registry format can express
+type RepositoryOptions struct {
+	// Path is the mirror directory relative to the mirrors directory,
+	// replacing the default provider/owner/name layout
+	Path string
+
+	// Refs lists the refs to mirror, like "refs/heads/main" or "refs/tags/*".
+	// Every ref is mirrored when empty.
+	Refs []string
+
+	// Interval is the minimum time between two syncs of the repository
+	Interval time.Duration
+
+	// LFS enables fetching Git LFS objects after each sync
+	LFS bool
+
+	// Labels are free-form tags attached to the repository
+	Labels []string
+
+	// Credentials names a credentials profile of the configuration file
+	Credentials string
+
+	// Retries and RetryDelay override the retry policy of the run for
+	// transient failures. Retries is nil when the run's count applies, and
+	// RetryDelay is zero when the run's base delay applies.
+	Retries    *int
+	RetryDelay time.Duration
+
+	// Timeout bounds the sync of the repository, retries included,
+	// overriding the timeout of the run
+	Timeout time.Duration
+}
+
+// registryEntry is a repository in the structured registry format. Repo
+// holds the same short form or URL accepted by the plain-text format, and
+// Include the target of an include directive.
+type registryEntry struct {
+	Repo        string   `json:"repo,omitempty"`
+	Include     string   `json:"include,omitempty"`
+	Path        string   `json:"path,omitempty"`
+	Refs        []string `json:"refs,omitempty"`
+	Interval    string   `json:"interval,omitempty"`
+	LFS         bool     `json:"lfs,omitempty"`
+	Labels      []string `json:"labels,omitempty"`
+	Credentials string   `json:"credentials,omitempty"`
+	Retries     *int     `json:"retries,omitempty"`
+	RetryDelay  string   `json:"retry_delay,omitempty"`
+	Timeout     string   `json:"timeout,omitempty"`
+
+	// Line and Column are where the entry starts in its file
+	Line   int `json:"-"`
+	Column int `json:"-"`
+}
+
+// sourcedRepository is a repository along with where it was listed
+type sourcedRepository struct {
+	Repository
+	File   string
+	Line   int
+	Column int
+}
+
+// registryProblem is an invalid or conflicting registry entry along with
+// its location
+type registryProblem struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Entry    string `json:"entry,omitempty"`
+	Message  string `json:"message"`
+}
+
+// Problem severities. Errors make validation fail, warnings do not.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// problemError is a registry error that stops loading, at a known position
+// of a file
+type problemError struct {
+	registryProblem
+}
+
+func (e *problemError) Error() string {
+	return e.registryProblem.String()
+}
+
+func (p registryProblem) String() string {
+	if p.Entry == "" {
+		return fmt.Sprintf("%s: %s", p.location(), p.Message)
+	}
+	return fmt.Sprintf("%s: %s (%s)", p.location(), p.Message, p.Entry)
+}
+
+// diagnostic describes the problem with its severity, in the style of
+// compiler messages
+func (p registryProblem) diagnostic() string {
+	message := p.Message
+	if p.Entry != "" {
+		message = fmt.Sprintf("%s (%s)", message, p.Entry)
+	}
+	return fmt.Sprintf("%s: %s: %s", p.location(), p.Severity, message)
+}
+
+// location returns the "file:line:column" position of the problem, or just
+// the file when the problem is not about a single entry
+func (p registryProblem) location() string {
+	if p.Line == 0 {
+		return p.File
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// includeDirective starts a plain-text registry line that reads other
+// registry files, given as a path or glob relative to the including file
+const includeDirective = "@include"
+
+// structuredRegistry is the top-level document of a structured registry file
+type structuredRegistry struct {
+	Repositories []registryEntry `json:"repositories"`
+}
+
+// isStructuredRegistry reports whether filename uses the structured registry
+// format, which is detected by its extension
+func isStructuredRegistry(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".json")
+}
+
+// registryLoader reads registry files, following include directives
+type registryLoader struct {
+	// stack holds the files being read, to detect include cycles, and
+	// loaded the files already read, which a second include skips
+	stack    []string
+	loaded   map[string]bool
+	repos    []sourcedRepository
+	excludes []ownerPattern
+
+	// problems collects the entries that were skipped
+	problems []registryProblem
+
+	// When noExpand is set, owner patterns are collected in patterns instead
+	// of being listed through the provider APIs
+	noExpand bool
+	patterns []sourcedPattern
+}
+
+// sourcedPattern is an owner pattern along with where it was listed
+type sourcedPattern struct {
+	ownerPattern
+	Entry string
+	File  string
+	Line  int
+}
+
+// loadDir reads every registry file of a directory, in name order
+func (l *registryLoader) loadDir(dir string) error {
+	var files []string
+	for _, pattern := range []string{"*.txt", "*.json"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		if err := l.loadFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads a registry file, or every registry file of a directory
+func (l *registryLoader) load(filename string) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", filename, err)
+	}
+	if info.IsDir() {
+		return l.loadDir(filename)
+	}
+	return l.loadFile(filename)
+}
+
+// loadFile reads a registry file in either format. Invalid entries are
+// recorded as problems and skipped, while unreadable files and include
+// cycles are errors.
+func (l *registryLoader) loadFile(filename string) error {
+	absolute, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	for i, file := range l.stack {
+		if file == absolute {
+			cycle := append(append([]string{}, l.stack[i:]...), absolute)
+			return fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	if l.loaded[absolute] {
+		return nil
+	}
+	if l.loaded == nil {
+		l.loaded = make(map[string]bool)
+	}
+	l.loaded[absolute] = true
+	l.stack = append(l.stack, absolute)
+	defer func() { l.stack = l.stack[:len(l.stack)-1] }()
+
+	entries, err := readRegistryEntries(filename)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		spec := strings.TrimSpace(entry.Repo)
+
+		switch {
+		case entry.Include != "":
+			if err := l.include(filename, entry); err != nil {
+				return err
+			}
+
+		// "!provider:owner/pattern" removes repositories from the list
+		case strings.HasPrefix(spec, "!"):
+			pattern, err := parseOwnerPattern(strings.TrimSpace(spec[1:]))
+			if err != nil {
+				l.invalid(filename, entry, err)
+				continue
+			}
+			l.excludes = append(l.excludes, pattern)
+
+		// "provider:owner/*" expands into the repositories of the owner
+		case isOwnerPattern(spec) && l.noExpand:
+			pattern, err := parseOwnerPattern(spec)
+			if err != nil {
+				l.invalid(filename, entry, err)
+				continue
+			}
+			l.patterns = append(l.patterns, sourcedPattern{ownerPattern: pattern, Entry: spec, File: filename, Line: entry.Line})
+
+		case isOwnerPattern(spec):
+			expanded, err := entry.expand()
+			if err != nil {
+				l.invalid(filename, entry, fmt.Errorf("failed to expand: %w", err))
+				continue
+			}
+			for _, repo := range expanded {
+				l.add(filename, entry, repo)
+			}
+
+		default:
+			repo, err := entry.repository()
+			if err != nil {
+				l.invalid(filename, entry, err)
+				continue
+			}
+			l.add(filename, entry, repo)
+		}
+	}
+
+	return nil
+}
+
+func (l *registryLoader) add(filename string, entry registryEntry, repo Repository) {
+	l.repos = append(l.repos, sourcedRepository{
+		Repository: repo,
+		File:       filename,
+		Line:       entry.Line,
+		Column:     entry.Column,
+	})
+}
+
+// invalid records a skipped entry. Plain-text entries point the column at
+// the offending part of the line when the parser knows it.
+func (l *registryLoader) invalid(filename string, entry registryEntry, err error) {
+	column := entry.Column
+	var syntaxErr *syntaxError
+	if errors.As(err, &syntaxErr) && !isStructuredRegistry(filename) {
+		column += syntaxErr.Offset
+	}
+
+	l.problems = append(l.problems, registryProblem{
+		File:     filename,
+		Line:     entry.Line,
+		Column:   column,
+		Severity: severityError,
+		Entry:    redactURL(strings.TrimSpace(entry.Repo)),
+		Message:  err.Error(),
+	})
+}
+
+// include reads the files named by an include entry. A missing file is an
+// error, while a glob matching nothing is not.
+func (l *registryLoader) include(filename string, entry registryEntry) error {
+	target := expandPath(strings.TrimSpace(entry.Include))
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(filename), target)
+	}
+
+	matches := []string{target}
+	if strings.ContainsAny(target, "*?[") {
+		var err error
+		if matches, err = filepath.Glob(target); err != nil {
+			return fmt.Errorf("%s:%d: invalid include pattern: %v", filename, entry.Line, err)
+		}
+		sort.Strings(matches)
+	}
+
+	for _, match := range matches {
+		if err := l.loadFile(match); err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, entry.Line, err)
+		}
+	}
+	return nil
+}
+
+// repositories returns the loaded repositories, without the excluded ones
+func (l *registryLoader) repositories() []sourcedRepository {
+	var kept []sourcedRepository
+	for _, repo := range l.repos {
+		if !isExcluded(repo.Repository, l.excludes) {
+			kept = append(kept, repo)
+		}
+	}
+	return kept
+}
+
+// duplicateEntry is a registry entry that resolves to the mirror directory of
+// an earlier entry
+type duplicateEntry struct {
+	Entry    sourcedRepository
+	Original sourcedRepository
+}
+
+func (d duplicateEntry) String() string {
+	return d.problem(severityWarning).String()
+}
+
+// problem describes the duplicate as a registry problem
+func (d duplicateEntry) problem(severity string) registryProblem {
+	return registryProblem{
+		File:     d.Entry.File,
+		Line:     d.Entry.Line,
+		Column:   d.Entry.Column,
+		Severity: severity,
+		Message: fmt.Sprintf("%s is already listed at %s:%d",
+			filepath.ToSlash(repositoryDir("", d.Entry.Repository)), d.Original.File, d.Original.Line),
+	}
+}
+
+// dedupeRepositories keeps the first of the entries that share a mirror
+// directory and returns the others as duplicates. Two workers cloning into
+// the same directory at once would corrupt it.
+func dedupeRepositories(repos []sourcedRepository) ([]sourcedRepository, []duplicateEntry) {
+	first := make(map[string]sourcedRepository)
+	var kept []sourcedRepository
+	var duplicates []duplicateEntry
+
+	for _, repo := range repos {
+		key := mirrorKey(repo.Repository)
+		if original, ok := first[key]; ok {
+			duplicates = append(duplicates, duplicateEntry{Entry: repo, Original: original})
+			continue
+		}
+		first[key] = repo
+		kept = append(kept, repo)
+	}
+
+	return kept, duplicates
+}
+
+// mirrorKey identifies the mirror directory of a repository. Names are
+// compared case-insensitively for providers that ignore case, where
+// "github:Golang/Go" and "github:golang/go" are the same repository.
+func mirrorKey(repo Repository) string {
+	key := filepath.ToSlash(repositoryDir("", repo))
+	if repo.Options != nil && repo.Options.Path != "" {
+		return key
+	}
+	if p, ok := providers[repo.Provider]; ok && caseInsensitiveKinds[p.Kind] {
+		return strings.ToLower(key)
+	}
+	return key
+}
+
+// readRegistryEntries reads the raw entries of a registry file in either
+// format, without resolving them. Plain-text lines become entries without
+// options.
+func readRegistryEntries(filename string) ([]registryEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			log.Printf("Warning: failed to close file: %v", err)
+		}
+	}()
+
+	if isStructuredRegistry(filename) {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading file: %v", err)
+		}
+		entries, err := decodeStructuredRegistry(data)
+		if err != nil {
+			var syntaxErr *syntaxError
+			if errors.As(err, &syntaxErr) {
+				line, column := textPosition(data, syntaxErr.Offset)
+				return nil, &problemError{registryProblem{
+					File:     filename,
+					Line:     line,
+					Column:   column,
+					Severity: severityError,
+					Message:  err.Error(),
+				}}
+			}
+			return nil, fmt.Errorf("failed to parse %s: %v", filename, err)
+		}
+		return entries, nil
+	}
+
+	var entries []registryEntry
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		raw := scanner.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue // Skip empty lines and comments
+		}
+		column := 1 + strings.Index(raw, line)
+
+		if target, ok := strings.CutPrefix(line, includeDirective); ok && (target == "" || target[0] == ' ' || target[0] == '\t') {
+			entries = append(entries, registryEntry{Include: strings.TrimSpace(target), Line: lineNumber, Column: column})
+			continue
+		}
+		entries = append(entries, registryEntry{Repo: line, Line: lineNumber, Column: column})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+
+	return entries, nil
+}
+
+// decodeStructuredRegistry decodes a JSON registry, recording the line where
+// each entry starts
+func decodeStructuredRegistry(data []byte) ([]registryEntry, error) {
+	var registry structuredRegistry
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&registry); err != nil {
+		offset := int(decoder.InputOffset())
+		var jsonSyntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &jsonSyntaxErr):
+			// The offset is past the offending byte
+			offset = int(jsonSyntaxErr.Offset) - 1
+		case errors.As(err, &typeErr):
+			offset = int(typeErr.Offset)
+		}
+		return nil, &syntaxError{Offset: offset, Err: err}
+	}
+
+	var raw struct {
+		Repositories []json.RawMessage `json:"repositories"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	// Entries keep their exact bytes in the raw messages and appear in order,
+	// so each one is found after the previous one
+	cursor := 0
+	for i, message := range raw.Repositories {
+		if i >= len(registry.Repositories) {
+			break
+		}
+		if at := bytes.Index(data[cursor:], message); at >= 0 {
+			cursor += at
+			registry.Repositories[i].Line, registry.Repositories[i].Column = textPosition(data, cursor)
+			cursor += len(message)
+		}
+	}
+
+	return registry.Repositories, nil
+}
+
+// textPosition converts a byte offset of data into a line and column, both
+// starting at 1
+func textPosition(data []byte, offset int) (line, column int) {
+	offset = min(max(offset, 0), len(data))
+	line = 1 + bytes.Count(data[:offset], []byte("\n"))
+	column = offset - bytes.LastIndexByte(data[:offset], '\n')
+	return line, column
+}
+
+// repository resolves a structured entry into a Repository with its options
+func (e registryEntry) repository() (Repository, error) {
+	repo, err := parseRepositoryLine(strings.TrimSpace(e.Repo))
+	if err != nil {
+		return Repository{}, err
+	}
+
+	repo.Options, err = e.options()
+	if err != nil {
+		return Repository{}, err
+	}
+	return repo, nil
+}
+
+// expand resolves an owner pattern entry into every matching repository,
+// each sharing the entry's options
+func (e registryEntry) expand() ([]Repository, error) {
+	if e.Path != "" {
+		return nil, fmt.Errorf("a custom path cannot be shared by the repositories of a pattern")
+	}
+	options, err := e.options()
+	if err != nil {
+		return nil, err
+	}
+
+	pattern, err := parseOwnerPattern(strings.TrimSpace(e.Repo))
+	if err != nil {
+		return nil, err
+	}
+	repos, err := expandOwnerPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range repos {
+		repos[i].Options = options
+	}
+	return repos, nil
+}
+
+// options validates the settings of an entry, returning nil when it has none
+func (e registryEntry) options() (*RepositoryOptions, error) {
+	if !e.hasOptions() {
+		return nil, nil
+	}
+
+	options := &RepositoryOptions{
+		Refs:        e.Refs,
+		LFS:         e.LFS,
+		Labels:      e.Labels,
+		Credentials: e.Credentials,
+		Retries:     e.Retries,
+	}
+
+	if e.Path != "" {
+		cleaned := path.Clean(filepath.ToSlash(e.Path))
+		if cleaned == "." || path.IsAbs(cleaned) || !filepath.IsLocal(filepath.FromSlash(cleaned)) {
+			return nil, fmt.Errorf("invalid path %q: must be relative to the mirrors directory", e.Path)
+		}
+		options.Path = cleaned
+	}
+
+	for _, ref := range e.Refs {
+		if !strings.HasPrefix(ref, "refs/") {
+			return nil, fmt.Errorf("invalid ref filter %q: must start with refs/", ref)
+		}
+	}
+
+	if e.Interval != "" {
+		interval, err := time.ParseDuration(e.Interval)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("invalid interval %q", e.Interval)
+		}
+		options.Interval = interval
+	}
+
+	if e.Retries != nil && *e.Retries < 0 {
+		return nil, fmt.Errorf("invalid retries %d: must not be negative", *e.Retries)
+	}
+
+	if e.RetryDelay != "" {
+		delay, err := time.ParseDuration(e.RetryDelay)
+		if err != nil || delay <= 0 {
+			return nil, fmt.Errorf("invalid retry delay %q", e.RetryDelay)
+		}
+		options.RetryDelay = delay
+	}
+
+	if e.Timeout != "" {
+		timeout, err := time.ParseDuration(e.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", e.Timeout)
+		}
+		options.Timeout = timeout
+	}
+
+	if e.Credentials != "" {
+		if _, ok := credentialProfiles[e.Credentials]; !ok {
+			return nil, fmt.Errorf("unknown credentials profile: %s", e.Credentials)
+		}
+	}
+
+	return options, nil
+}
+
+func (e registryEntry) hasOptions() bool {
+	return e.Path != "" || len(e.Refs) > 0 || e.Interval != "" || e.LFS ||
+		len(e.Labels) > 0 || e.Credentials != "" || e.Retries != nil || e.RetryDelay != "" ||
+		e.Timeout != ""
+}
+
+// writeRegistryEntries writes entries to filename in the format matching its
+// extension. Options cannot be expressed in the plain-text format, so they
+// are dropped with a warning.
+func writeRegistryEntries(filename string, entries []registryEntry) error {
+	var data []byte
+
+	if isStructuredRegistry(filename) {
+		registry := structuredRegistry{Repositories: entries}
+		if registry.Repositories == nil {
+			registry.Repositories = []registryEntry{}
+		}
+		encoded, err := json.MarshalIndent(registry, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(encoded, '\n')
+	} else {
+		var b strings.Builder
+		for _, entry := range entries {
+			if entry.Include != "" {
+				fmt.Fprintf(&b, "%s %s\n", includeDirective, entry.Include)
+				continue
+			}
+			if entry.hasOptions() {
+				log.Printf("Warning: options of '%s' cannot be written to a plain-text registry", entry.Repo)
+			}
+			b.WriteString(entry.Repo)
+			b.WriteString("\n")
+		}
+		data = []byte(b.String())
+	}
+
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+	return nil
+}
+
+// appendRegistryEntries adds lines at the end of a registry file whose
+// current entries are given. Plain-text registries keep their content as is,
+// with the new lines under comment when there is one, while structured
+// registries are rewritten.
+func appendRegistryEntries(filename string, entries []registryEntry, lines []string, comment string) error {
+	if isStructuredRegistry(filename) {
+		for _, line := range lines {
+			entries = append(entries, registryEntry{Repo: line})
+		}
+		return writeRegistryEntries(filename, entries)
+	}
+
+	content, err := os.ReadFile(filename)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	var b strings.Builder
+	b.Write(content)
+	if len(content) > 0 && !strings.HasSuffix(string(content), "\n") {
+		b.WriteString("\n")
+	}
+	if comment != "" {
+		if len(content) > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "# %s\n", comment)
+	}
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+
+	if err := os.WriteFile(filename, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+	return nil
+}
+
+// convertRegistry converts a registry file into the format of output, as
+// detected by the output file extension
+func convertRegistry(input, output string) (int, error) {
+	entries, err := readRegistryEntries(input)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeRegistryEntries(output, entries); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadStructuredRegistry(t *testing.T) {
+	saved := credentialProfiles
+	credentialProfiles = map[string]Credentials{"work": {TokenEnv: "WORK_TOKEN"}}
+	t.Cleanup(func() { credentialProfiles = saved })
+
+	content := `{
+  "repositories": [
+    {"repo": "github:golang/go"},
+    {
+      "repo": "gitlab:group/subgroup/project",
+      "path": "work/project",
+      "refs": ["refs/heads/main", "refs/tags/*"],
+      "interval": "6h",
+      "lfs": true,
+      "labels": ["work", "infra"],
+      "credentials": "work",
+      "retries": 5,
+      "retry_delay": "10s",
+      "timeout": "1h"
+    },
+    {"repo": "invalid-entry"},
+    {"repo": "github:owner/escape", "path": "../outside"},
+    {"repo": "github:owner/badref", "refs": ["main"]},
+    {"repo": "github:owner/badinterval", "interval": "soon"},
+    {"repo": "github:owner/nocreds", "credentials": "missing"},
+    {"repo": "github:owner/badretries", "retries": -1},
+    {"repo": "github:owner/badretrydelay", "retry_delay": "0s"},
+    {"repo": "github:owner/badtimeout", "timeout": "-1h"}
+  ]
+}`
+	tmpFile := filepath.Join(t.TempDir(), "registry.json")
+	if err := os.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	repos, err := readRegistry(tmpFile)
+	if err != nil {
+		t.Fatalf("readRegistry() unexpected error: %v", err)
+	}
+	if len(repos) != 2 {
+		t.Fatalf("readRegistry() returned %d repositories, want 2", len(repos))
+	}
+
+	plain := Repository{Provider: "github", Owner: "golang", Name: "go", URL: "https://github.com/golang/go.git"}
+	if repos[0] != plain {
+		t.Errorf("Repository at index 0: got %+v, want %+v", repos[0], plain)
+	}
+
+	retries := 5
+	expectedOptions := &RepositoryOptions{
+		Path:        "work/project",
+		Refs:        []string{"refs/heads/main", "refs/tags/*"},
+		Interval:    6 * time.Hour,
+		LFS:         true,
+		Labels:      []string{"work", "infra"},
+		Credentials: "work",
+		Retries:     &retries,
+		RetryDelay:  10 * time.Second,
+		Timeout:     time.Hour,
+	}
+	if !reflect.DeepEqual(repos[1].Options, expectedOptions) {
+		t.Errorf("Options at index 1: got %+v, want %+v", repos[1].Options, expectedOptions)
+	}
+	if repos[1].Owner != "group/subgroup" || repos[1].Name != "project" {
+		t.Errorf("Repository at index 1: got %+v", repos[1])
+	}
+
+	expectedDir := filepath.Join("mirrors", "work", "project")
+	if dir := repositoryDir("mirrors", repos[1]); dir != expectedDir {
+		t.Errorf("repositoryDir() = %q, want %q", dir, expectedDir)
+	}
+}
+
+func TestReadStructuredRegistryMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"invalid json", `{"repositories": [`},
+		{"unknown field", `{"repositories": [{"repo": "github:golang/go", "mirror": true}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpFile := filepath.Join(t.TempDir(), "registry.json")
+			if err := os.WriteFile(tmpFile, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("Failed to create test file: %v", err)
+			}
+
+			if _, err := readRegistry(tmpFile); err == nil {
+				t.Error("readRegistry() expected error but got none")
+			}
+		})
+	}
+}
+
+func TestConvertRegistry(t *testing.T) {
+	tmpDir := t.TempDir()
+	textFile := filepath.Join(tmpDir, "registry.txt")
+	jsonFile := filepath.Join(tmpDir, "registry.json")
+	backFile := filepath.Join(tmpDir, "registry-back.txt")
+
+	content := "# Go\ngithub:golang/go\n\nhttps://git.example.com/team/tool.git\n"
+	if err := os.WriteFile(textFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	count, err := convertRegistry(textFile, jsonFile)
+	if err != nil {
+		t.Fatalf("convertRegistry(txt, json) unexpected error: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("convertRegistry(txt, json) converted %d entries, want 2", count)
+	}
+
+	repos, err := readRegistry(jsonFile)
+	if err != nil {
+		t.Fatalf("readRegistry(json) unexpected error: %v", err)
+	}
+	if len(repos) != 2 || repos[1].Provider != "git.example.com" {
+		t.Errorf("readRegistry(json) = %+v", repos)
+	}
+
+	if _, err := convertRegistry(jsonFile, backFile); err != nil {
+		t.Fatalf("convertRegistry(json, txt) unexpected error: %v", err)
+	}
+	back, err := os.ReadFile(backFile)
+	if err != nil {
+		t.Fatalf("Failed to read converted file: %v", err)
+	}
+	expected := "github:golang/go\nhttps://git.example.com/team/tool.git\n"
+	if string(back) != expected {
+		t.Errorf("converted text registry = %q, want %q", back, expected)
+	}
+}
+
+// writeRegistryFiles creates files under dir from a name to content map
+func writeRegistryFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+}
+
+func TestReadRegistryIncludes(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeRegistryFiles(t, tmpDir, map[string]string{
+		"registry.txt":       "github:golang/go\n@include teams/*.txt\n@include extra.json\n",
+		"teams/infra.txt":    "gitlab:group/infra\n",
+		"teams/platform.txt": "# Platform\ngithub:org/platform\n",
+		"extra.json":         `{"repositories": [{"repo": "gitea:john/doerepo"}, {"include": "teams/infra.txt"}]}`,
+	})
+
+	// Including a file twice is not a cycle, and its entries are only read
+	// once rather than reported as duplicates of themselves
+	repos, err := loadRegistry(filepath.Join(tmpDir, "registry.txt"), true)
+	if err != nil {
+		t.Fatalf("loadRegistry() in strict mode unexpected error: %v", err)
+	}
+
+	expected := []string{"github:golang/go", "gitlab:group/infra", "github:org/platform", "gitea:john/doerepo"}
+	var paths []string
+	for _, repo := range repos {
+		paths = append(paths, repo.Provider+":"+repo.Owner+"/"+repo.Name)
+	}
+	if fmt.Sprint(paths) != fmt.Sprint(expected) {
+		t.Errorf("loadRegistry() = %v, want %v", paths, expected)
+	}
+}
+
+func TestReadRegistryIncludeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{
+			name: "include cycle",
+			files: map[string]string{
+				"registry.txt": "github:golang/go\n@include a.txt\n",
+				"a.txt":        "@include b.txt\n",
+				"b.txt":        "@include a.txt\n",
+			},
+		},
+		{
+			name:  "self include",
+			files: map[string]string{"registry.txt": "@include registry.txt\n"},
+		},
+		{
+			name:  "missing include",
+			files: map[string]string{"registry.txt": "@include missing.txt\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			writeRegistryFiles(t, tmpDir, tt.files)
+
+			if _, err := readRegistry(filepath.Join(tmpDir, "registry.txt")); err == nil {
+				t.Error("readRegistry() expected error but got none")
+			}
+		})
+	}
+}
+
+func TestReadRegistryDirectory(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeRegistryFiles(t, tmpDir, map[string]string{
+		"a-go.txt":     "github:golang/go\ngithub:golang/tools\n",
+		"b-dupes.txt":  "# Same mirror directory as a-go.txt\nhttps://github.com/golang/go.git\ngithub:NixOS/nix\n",
+		"c-extra.json": `{"repositories": [{"repo": "github:NixOS/nix"}]}`,
+		"notes.md":     "github:ignored/file\n",
+	})
+
+	repos, err := readRegistry(tmpDir)
+	if err != nil {
+		t.Fatalf("readRegistry() unexpected error: %v", err)
+	}
+
+	expected := []string{"github:golang/go", "github:golang/tools", "github:NixOS/nix"}
+	var paths []string
+	for _, repo := range repos {
+		paths = append(paths, repo.Provider+":"+repo.Owner+"/"+repo.Name)
+	}
+	if fmt.Sprint(paths) != fmt.Sprint(expected) {
+		t.Errorf("readRegistry() = %v, want %v", paths, expected)
+	}
+	if repos[0].URL != "https://github.com/golang/go.git" {
+		t.Errorf("first entry should be kept, got %+v", repos[0])
+	}
+}
+
+func TestDecodeStructuredRegistryLines(t *testing.T) {
+	data := []byte(`{
+  "repositories": [
+    {"repo": "github:golang/go"},
+    {
+      "repo": "github:golang/go"
+    },
+    {"include": "other.json"}
+  ]
+}`)
+
+	entries, err := decodeStructuredRegistry(data)
+	if err != nil {
+		t.Fatalf("decodeStructuredRegistry() unexpected error: %v", err)
+	}
+
+	var lines []int
+	for _, entry := range entries {
+		lines = append(lines, entry.Line)
+	}
+	if fmt.Sprint(lines) != "[3 4 7]" {
+		t.Errorf("entry lines = %v, want [3 4 7]", lines)
+	}
+}
+
+func TestLoadRegistryDuplicates(t *testing.T) {
+	content := `github:golang/go
+github:Golang/Go
+https://github.com/golang/go.git
+codecommit:us-east-1/Repo
+codecommit:us-east-1/repo
+gitlab:group/project
+`
+	tmpFile := filepath.Join(t.TempDir(), "registry.txt")
+	if err := os.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	repos, err := loadRegistry(tmpFile, false)
+	if err != nil {
+		t.Fatalf("loadRegistry() unexpected error: %v", err)
+	}
+
+	// GitHub names ignore case while CodeCommit names do not
+	expected := []string{"github:golang/go", "codecommit:us-east-1/Repo", "codecommit:us-east-1/repo", "gitlab:group/project"}
+	var paths []string
+	for _, repo := range repos {
+		paths = append(paths, repo.Provider+":"+repo.Owner+"/"+repo.Name)
+	}
+	if fmt.Sprint(paths) != fmt.Sprint(expected) {
+		t.Errorf("loadRegistry() = %v, want %v", paths, expected)
+	}
+
+	_, err = loadRegistry(tmpFile, true)
+	if err == nil {
+		t.Fatal("loadRegistry() in strict mode expected error but got none")
+	}
+	for _, location := range []string{"registry.txt:2", "registry.txt:3"} {
+		if !strings.Contains(err.Error(), location) {
+			t.Errorf("strict error %q should name %s", err, location)
+		}
+	}
+}
+
+func TestLoadRegistryStrictWithoutDuplicates(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "registry.txt")
+	if err := os.WriteFile(tmpFile, []byte("github:golang/go\ngithub:golang/tools\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	repos, err := loadRegistry(tmpFile, true)
+	if err != nil {
+		t.Fatalf("loadRegistry() unexpected error: %v", err)
+	}
+	if len(repos) != 2 {
+		t.Errorf("loadRegistry() returned %d repositories, want 2", len(repos))
+	}
+}
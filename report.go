@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// reportFormats are the accepted values of -report-format
+var reportFormats = []string{"json", "ndjson", "junit"}
+
+// reportEntry is the outcome of one repository in a run report
+type reportEntry struct {
+	// Type tells entries from the summary apart in NDJSON reports
+	Type          string      `json:"type,omitempty"`
+	Repository    string      `json:"repository"`
+	URL           string      `json:"url"`
+	Status        string      `json:"status"`
+	Duration      float64     `json:"duration_seconds"`
+	BytesReceived int64       `json:"bytes_received"`
+	ChangedRefs   int         `json:"changed_refs"`
+	Attempts      int         `json:"attempts,omitempty"`
+	Category      string      `json:"error_category,omitempty"`
+	Error         string      `json:"error,omitempty"`
+	Stderr        string      `json:"stderr,omitempty"`
+	Refs          []refUpdate `json:"refs,omitempty"`
+}
+
+// reportSummary is the summary block of a run report
+type reportSummary struct {
+	Type      string    `json:"type,omitempty"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	Duration  float64   `json:"duration_seconds"`
+	Total     int       `json:"total"`
+	Succeeded int       `json:"succeeded"`
+	Failed    int       `json:"failed"`
+	Cloned    int       `json:"cloned"`
+	Updated   int       `json:"updated"`
+	Unchanged int       `json:"unchanged"`
+	Skipped   int       `json:"skipped"`
+}
+
+// summarizeResults counts the results of a run that started at started
+func summarizeResults(results []Result, started time.Time) reportSummary {
+	summary := reportSummary{Started: started, Finished: time.Now(), Total: len(results)}
+	summary.Duration = summary.Finished.Sub(started).Seconds()
+	for _, result := range results {
+		if result.Succeeded() {
+			summary.Succeeded++
+		}
+		switch result.Action {
+		case resultCloned:
+			summary.Cloned++
+		case resultUpdated:
+			summary.Updated++
+		case resultUnchanged:
+			summary.Unchanged++
+		case resultSkipped:
+			summary.Skipped++
+		case resultFailed:
+			summary.Failed++
+		}
+	}
+	return summary
+}
+
+// newReportEntry converts a result into its report entry
+func newReportEntry(result Result) reportEntry {
+	repo := result.Repository
+	entry := reportEntry{
+		Repository:    repo.Provider + ":" + repo.Owner + "/" + repo.Name,
+		URL:           redactURL(repo.URL),
+		Status:        result.Action,
+		Duration:      result.Duration.Seconds(),
+		BytesReceived: result.BytesReceived,
+		ChangedRefs:   result.ChangedRefs,
+		Attempts:      result.Attempts,
+		Category:      result.Category,
+		Stderr:        result.Stderr,
+		Refs:          result.RefUpdates,
+	}
+	if result.Err != nil {
+		entry.Error = result.Err.Error()
+	}
+	return entry
+}
+
+// writeReport writes the results of a run in the given format: a single JSON
+// document, one JSON object per line with the summary last, or a JUnit XML
+// test suite where each repository is a test case
+func writeReport(w io.Writer, format string, results []Result, summary reportSummary) error {
+	switch format {
+	case "json":
+		report := struct {
+			Repositories []reportEntry `json:"repositories"`
+			Summary      reportSummary `json:"summary"`
+		}{Repositories: []reportEntry{}, Summary: summary}
+		for _, result := range results {
+			report.Repositories = append(report.Repositories, newReportEntry(result))
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+
+	case "ndjson":
+		encoder := json.NewEncoder(w)
+		for _, result := range results {
+			entry := newReportEntry(result)
+			entry.Type = "repository"
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		summary.Type = "summary"
+		return encoder.Encode(summary)
+
+	case "junit":
+		return writeJUnitReport(w, results, summary)
+	}
+
+	return fmt.Errorf("unsupported report format: %s", format)
+}
+
+// JUnit XML elements, as read by CI systems
+type (
+	junitTestSuites struct {
+		XMLName xml.Name     `xml:"testsuites"`
+		Suites  []junitSuite `xml:"testsuite"`
+	}
+	junitSuite struct {
+		Name      string      `xml:"name,attr"`
+		Tests     int         `xml:"tests,attr"`
+		Failures  int         `xml:"failures,attr"`
+		Skipped   int         `xml:"skipped,attr"`
+		Time      float64     `xml:"time,attr"`
+		Timestamp string      `xml:"timestamp,attr"`
+		Cases     []junitCase `xml:"testcase"`
+	}
+	junitCase struct {
+		Classname string        `xml:"classname,attr"`
+		Name      string        `xml:"name,attr"`
+		Time      float64       `xml:"time,attr"`
+		Failure   *junitFailure `xml:"failure,omitempty"`
+		Skipped   *struct{}     `xml:"skipped,omitempty"`
+		SystemOut string        `xml:"system-out,omitempty"`
+	}
+	junitFailure struct {
+		Message string `xml:"message,attr"`
+		Type    string `xml:"type,attr"`
+		Text    string `xml:",chardata"`
+	}
+)
+
+// writeJUnitReport writes the results as a JUnit XML test suite. Repositories
+// are grouped by provider and owner in the test case class names.
+func writeJUnitReport(w io.Writer, results []Result, summary reportSummary) error {
+	suite := junitSuite{
+		Name:      AppName,
+		Tests:     summary.Total,
+		Failures:  summary.Failed,
+		Skipped:   summary.Skipped,
+		Time:      summary.Duration,
+		Timestamp: summary.Started.UTC().Format(time.RFC3339),
+	}
+	for _, result := range results {
+		repo := result.Repository
+		testCase := junitCase{
+			Classname: repo.Provider + "." + strings.ReplaceAll(repo.Owner, "/", "."),
+			Name:      repo.Name,
+			Time:      result.Duration.Seconds(),
+			SystemOut: result.String(),
+		}
+		switch result.Action {
+		case resultFailed:
+			testCase.Failure = &junitFailure{Message: result.Err.Error(), Type: result.Category, Text: result.Stderr}
+		case resultSkipped:
+			testCase.Skipped = &struct{}{}
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(junitTestSuites{Suites: []junitSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
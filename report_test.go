@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sampleResults returns one result of each kind
+func sampleResults() []Result {
+	return []Result{
+		{
+			Repository:  Repository{Provider: "github", Owner: "golang", Name: "go", URL: "https://github.com/golang/go.git"},
+			Action:      resultUpdated,
+			Duration:    2 * time.Second,
+			ChangedRefs: 1,
+			RefUpdates:  []refUpdate{{Ref: "refs/heads/master", Old: "aaa", New: "bbb"}},
+		},
+		{
+			Repository: Repository{Provider: "gitlab", Owner: "group/subgroup", Name: "project"},
+			Action:     resultUnchanged,
+		},
+		failedResult(Repository{Provider: "github", Owner: "someone", Name: "gone"}, categoryGit,
+			errors.New("Clone failed: exit status 128"), "fatal: repository not found"),
+	}
+}
+
+func TestSummarizeResults(t *testing.T) {
+	summary := summarizeResults(sampleResults(), time.Now().Add(-time.Minute))
+	if summary.Total != 3 || summary.Succeeded != 2 || summary.Failed != 1 || summary.Updated != 1 || summary.Unchanged != 1 {
+		t.Errorf("summarizeResults() = %+v", summary)
+	}
+	if summary.Duration < 60 {
+		t.Errorf("summary duration = %v, want at least a minute", summary.Duration)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	results := sampleResults()
+	summary := summarizeResults(results, time.Now())
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := writeReport(&out, "json", results, summary); err != nil {
+			t.Fatalf("writeReport() unexpected error: %v", err)
+		}
+		var report struct {
+			Repositories []reportEntry `json:"repositories"`
+			Summary      reportSummary `json:"summary"`
+		}
+		if err := json.Unmarshal(out.Bytes(), &report); err != nil {
+			t.Fatalf("report is not valid JSON: %v", err)
+		}
+		if len(report.Repositories) != 3 || report.Summary.Failed != 1 {
+			t.Fatalf("report = %+v", report)
+		}
+		updated := report.Repositories[0]
+		if updated.Status != "updated" || updated.Duration != 2 || len(updated.Refs) != 1 || updated.Refs[0].New != "bbb" {
+			t.Errorf("updated entry = %+v", updated)
+		}
+		failed := report.Repositories[2]
+		if failed.Error == "" || failed.Category != categoryGit || failed.Stderr != "fatal: repository not found" {
+			t.Errorf("failed entry = %+v", failed)
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := writeReport(&out, "ndjson", results, summary); err != nil {
+			t.Fatalf("writeReport() unexpected error: %v", err)
+		}
+		var types []string
+		scanner := bufio.NewScanner(&out)
+		for scanner.Scan() {
+			var line struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatalf("line %q is not valid JSON: %v", scanner.Text(), err)
+			}
+			types = append(types, line.Type)
+		}
+		if expected := "repository repository repository summary"; strings.Join(types, " ") != expected {
+			t.Errorf("line types = %v, want %s", types, expected)
+		}
+	})
+
+	t.Run("junit", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := writeReport(&out, "junit", results, summary); err != nil {
+			t.Fatalf("writeReport() unexpected error: %v", err)
+		}
+		var suites junitTestSuites
+		if err := xml.Unmarshal(out.Bytes(), &suites); err != nil {
+			t.Fatalf("report is not valid XML: %v", err)
+		}
+		suite := suites.Suites[0]
+		if suite.Tests != 3 || suite.Failures != 1 || len(suite.Cases) != 3 {
+			t.Fatalf("test suite = %+v", suite)
+		}
+		if suite.Cases[1].Classname != "gitlab.group.subgroup" || suite.Cases[2].Failure == nil {
+			t.Errorf("test cases = %+v", suite.Cases)
+		}
+	})
+
+	if err := writeReport(&bytes.Buffer{}, "yaml", results, summary); err == nil {
+		t.Error("writeReport() with an unknown format expected error but got none")
+	}
+}
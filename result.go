@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Actions reported in a Result
+const (
+	resultCloned    = "cloned"
+	resultUpdated   = "updated"
+	resultUnchanged = "unchanged"
+	resultSkipped   = "skipped"
+	resultFailed    = "failed"
+)
+
+// Error categories of a failed Result
+const (
+	// categoryFilesystem is a failure to prepare the mirror directory
+	categoryFilesystem = "filesystem"
+	// categoryGit is a failed git command whose error output matches none of
+	// the categories below
+	categoryGit = "git"
+	// categoryTransient is a network error or an HTTP 429 or 5xx response,
+	// which is retried
+	categoryTransient = "transient"
+	// categoryAuth is a remote that rejected the credentials, or asked for
+	// some when there were none
+	categoryAuth = "auth"
+	// categoryNotFound is a remote repository that does not exist
+	categoryNotFound = "not-found"
+	// categoryCorruption is a mirror or a transfer with broken objects
+	categoryCorruption = "corruption"
+	// categoryLFS is a failed Git LFS fetch
+	categoryLFS = "lfs"
+	// categoryTimeout is a sync stopped by the run deadline, its repository
+	// timeout, or the stall detector
+	categoryTimeout = "timeout"
+	// categoryCanceled is a sync stopped by SIGINT or SIGTERM
+	categoryCanceled = "canceled"
+)
+
+// Result is the outcome of syncing one repository. Err, Category and Stderr
+// are only set when Action is failed, and Synced only when it is skipped.
+type Result struct {
+	Repository Repository
+	Action     string
+	Category   string
+	Err        error
+	// Stderr is the error output of the git command that failed
+	Stderr   string
+	Duration time.Duration
+	// BytesReceived is how much the objects of the mirror grew
+	BytesReceived int64
+	// ChangedRefs counts the refs created, moved or deleted, which are
+	// listed in RefUpdates
+	ChangedRefs int
+	RefUpdates  []refUpdate
+	Synced      time.Time
+	// Attempts counts the clones or updates tried, more than one when
+	// transient failures were retried
+	Attempts int
+}
+
+// failedResult returns the Result of a sync that failed in the given
+// category. stderr is the error output of the git command, if any.
+func failedResult(repo Repository, category string, err error, stderr string) Result {
+	return Result{
+		Repository: repo,
+		Action:     resultFailed,
+		Category:   category,
+		Err:        err,
+		Stderr:     stderr,
+	}
+}
+
+// gitFailedResult returns the Result of a failed git command, categorized by
+// its error output unless it was killed for a timeout or cancellation
+func gitFailedResult(repo Repository, err error, stderr string) Result {
+	category := contextCategory(err)
+	if category == "" {
+		category = classifyGitError(stderr)
+	}
+	return failedResult(repo, category, err, stderr)
+}
+
+// Succeeded reports whether the repository is in sync
+func (r Result) Succeeded() bool {
+	return r.Action != resultFailed
+}
+
+// String renders the result as a line of the sync output
+func (r Result) String() string {
+	name := r.Repository.Owner + "/" + r.Repository.Name
+
+	switch r.Action {
+	case resultCloned:
+		return fmt.Sprintf("✓ %s: Cloned successfully (%s)", name, r.details())
+	case resultUpdated:
+		return fmt.Sprintf("✓ %s: Updated, %d refs changed (%s)", name, r.ChangedRefs, r.details())
+	case resultUnchanged:
+		return fmt.Sprintf("✓ %s: Already up to date", name)
+	case resultSkipped:
+		return fmt.Sprintf("✓ %s: Skipped, synced %s ago", name, time.Since(r.Synced).Round(time.Second))
+	}
+
+	return fmt.Sprintf("✗ %s: %s", name, r.errorMessage())
+}
+
+// errorMessage describes the failure of a failed result, followed by the
+// reason git gave for it
+func (r Result) errorMessage() string {
+	message := fmt.Sprint(r.Err)
+	if line := lastLine(r.Stderr); line != "" {
+		message += ": " + line
+	}
+	return message
+}
+
+// details describes the transfer of a clone or update
+func (r Result) details() string {
+	return fmt.Sprintf("%s received in %s", formatBytes(r.BytesReceived), r.Duration.Round(time.Millisecond))
+}
+
+// formatBytes renders a size with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// lastLine returns the last non-empty line of output, which is where git
+// puts the reason of a failure
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// objectsSize returns the size of the objects of a bare repository, or 0 when
+// it does not exist yet
+func objectsSize(repoDir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(filepath.Join(repoDir, "objects"), func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// refUpdate is a ref created, moved or deleted by a sync. Old is empty for
+// created refs and New for deleted ones.
+type refUpdate struct {
+	Ref string `json:"ref"`
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+}
+
+// diffRefs compares two git show-ref listings and returns the refs that were
+// created, deleted or moved, sorted by name
+func diffRefs(before, after string) []refUpdate {
+	parse := func(output string) map[string]string {
+		refs := make(map[string]string)
+		for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+			if hash, ref, found := strings.Cut(line, " "); found {
+				refs[ref] = hash
+			}
+		}
+		return refs
+	}
+
+	beforeRefs, afterRefs := parse(before), parse(after)
+	var updates []refUpdate
+	for ref, hash := range afterRefs {
+		if beforeRefs[ref] != hash {
+			updates = append(updates, refUpdate{Ref: ref, Old: beforeRefs[ref], New: hash})
+		}
+	}
+	for ref, hash := range beforeRefs {
+		if _, ok := afterRefs[ref]; !ok {
+			updates = append(updates, refUpdate{Ref: ref, Old: hash})
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Ref < updates[j].Ref })
+	return updates
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorRepositoryResults(t *testing.T) {
+	source := createSourceRepository(t)
+	mirrorsDir := t.TempDir()
+	repo := Repository{Provider: "local", Owner: "test", Name: "source", URL: source}
+
+	cloned := mirrorRepository(context.Background(), mirrorsDir, repo)
+	if cloned.Action != resultCloned || cloned.ChangedRefs != 3 || cloned.BytesReceived == 0 || cloned.Duration == 0 {
+		t.Errorf("first mirrorRepository() = %+v, want a clone of 3 refs", cloned)
+	}
+
+	if unchanged := mirrorRepository(context.Background(), mirrorsDir, repo); unchanged.Action != resultUnchanged {
+		t.Errorf("second mirrorRepository() = %+v, want unchanged", unchanged)
+	}
+
+	if err := os.WriteFile(filepath.Join(source, "CHANGES.md"), []byte("changes\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	runGit(t, source, "add", "CHANGES.md")
+	runGit(t, source, "commit", "--quiet", "-m", "Add changes")
+	runGit(t, source, "tag", "v1.1.0")
+	if updated := mirrorRepository(context.Background(), mirrorsDir, repo); updated.Action != resultUpdated || updated.ChangedRefs != 2 {
+		t.Errorf("third mirrorRepository() = %+v, want an update of 2 refs", updated)
+	}
+
+	missing := Repository{Provider: "local", Owner: "test", Name: "missing", URL: filepath.Join(t.TempDir(), "missing")}
+	failed := mirrorRepository(context.Background(), mirrorsDir, missing)
+	if failed.Succeeded() || failed.Category != categoryNotFound || failed.Err == nil || failed.Stderr == "" {
+		t.Errorf("mirrorRepository() of a missing remote = %+v, want a not-found failure with its stderr", failed)
+	}
+}
+
+func TestResultString(t *testing.T) {
+	repo := Repository{Provider: "github", Owner: "golang", Name: "go"}
+	tests := []struct {
+		result   Result
+		expected string
+	}{
+		{
+			result:   Result{Repository: repo, Action: resultCloned, BytesReceived: 3 << 20, Duration: 1500 * time.Millisecond},
+			expected: "✓ golang/go: Cloned successfully (3.0 MiB received in 1.5s)",
+		},
+		{
+			result:   Result{Repository: repo, Action: resultUpdated, ChangedRefs: 2, BytesReceived: 512, Duration: time.Second},
+			expected: "✓ golang/go: Updated, 2 refs changed (512 B received in 1s)",
+		},
+		{
+			result:   Result{Repository: repo, Action: resultUnchanged},
+			expected: "✓ golang/go: Already up to date",
+		},
+		{
+			result:   failedResult(repo, categoryGit, errors.New("Clone failed: exit status 128"), "Cloning...\nfatal: repository not found\n"),
+			expected: "✗ golang/go: Clone failed: exit status 128: fatal: repository not found",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.result.String(); got != tt.expected {
+			t.Errorf("String() = %q, want %q", got, tt.expected)
+		}
+	}
+}
+
+func TestDiffRefs(t *testing.T) {
+	before := "aaa refs/heads/main\nbbb refs/heads/dev\nccc refs/tags/v1\n"
+	after := "ddd refs/heads/main\nccc refs/tags/v1\neee refs/tags/v2\n"
+
+	// main moved, dev was deleted and v2 was created
+	expected := []refUpdate{
+		{Ref: "refs/heads/dev", Old: "bbb"},
+		{Ref: "refs/heads/main", Old: "aaa", New: "ddd"},
+		{Ref: "refs/tags/v2", New: "eee"},
+	}
+	if updates := diffRefs(before, after); !reflect.DeepEqual(updates, expected) {
+		t.Errorf("diffRefs() = %+v, want %+v", updates, expected)
+	}
+	if updates := diffRefs(after, after); len(updates) != 0 {
+		t.Errorf("diffRefs() of the same refs = %+v, want none", updates)
+	}
+	if !strings.Contains(formatBytes(5<<30), "GiB") {
+		t.Errorf("formatBytes(5 GiB) = %s", formatBytes(5<<30))
+	}
+}
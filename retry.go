@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math/rand"
+	"regexp"
+	"time"
+)
+
+// maxRetryDelay caps the backoff between two attempts
+const maxRetryDelay = 5 * time.Minute
+
+// gitErrorPatterns classify the error output of git, checked in order. A
+// dropped connection often ends in "index-pack failed" as well, so transient
+// errors are matched before corruption.
+var gitErrorPatterns = []struct {
+	category string
+	pattern  *regexp.Regexp
+}{
+	{categoryAuth, regexp.MustCompile(`(?i)authentication failed|could not read (username|password)|terminal prompts disabled|permission denied \(publickey|access denied|returned error: 40[13]\b|invalid credentials`)},
+	{categoryNotFound, regexp.MustCompile(`(?i)repository .*not found|returned error: 404\b|does not appear to be a git repository|repository .* does not exist|project you were looking for could not be found`)},
+	{categoryTransient, regexp.MustCompile(`(?i)returned error: (429|5\d\d)\b|could not resolve host|temporary failure in name resolution|failed to connect|connection (refused|reset|timed out)|operation timed out|timed out after|early eof|rpc failed|unexpected disconnect|remote end hung up|gnutls_handshake|ssl_read|ssl_connect|tls connection|network is unreachable|http/2 stream \d+ was not closed`)},
+	{categoryCorruption, regexp.MustCompile(`(?i)bad object|is corrupt|object file .* is empty|index-pack failed|did not send all necessary objects|packfile .* cannot be accessed|broken link|invalid object|inflate: data stream error|fsck error|missing (blob|tree|commit)`)},
+}
+
+// classifyGitError returns the error category of a failed git command from
+// its error output, or categoryGit when it matches no known failure
+func classifyGitError(stderr string) string {
+	for _, p := range gitErrorPatterns {
+		if p.pattern.MatchString(stderr) {
+			return p.category
+		}
+	}
+	return categoryGit
+}
+
+// retryPolicy is how many times a transiently failing sync is retried, and
+// the base delay of the exponential backoff between attempts
+type retryPolicy struct {
+	Retries int
+	Delay   time.Duration
+}
+
+// defaultRetryPolicy applies to the repositories without retry settings of
+// their own, and is set by the -retries and -retry-delay flags of sync
+var defaultRetryPolicy = retryPolicy{Retries: 2, Delay: 2 * time.Second}
+
+// repositoryRetryPolicy returns the retry policy of repo, where its structured
+// registry settings override the default one
+func repositoryRetryPolicy(repo Repository) retryPolicy {
+	policy := defaultRetryPolicy
+	if repo.Options == nil {
+		return policy
+	}
+	if repo.Options.Retries != nil {
+		policy.Retries = *repo.Options.Retries
+	}
+	if repo.Options.RetryDelay > 0 {
+		policy.Delay = repo.Options.RetryDelay
+	}
+	return policy
+}
+
+// backoff returns the delay before the retry following the given attempt,
+// counted from 1: the base delay doubled for each previous attempt, up to
+// maxRetryDelay, less a random jitter of up to half of it so that workers
+// failing together do not retry together
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.Delay
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRetryDelay)
+	if half := int64(delay / 2); half > 0 {
+		delay = delay/2 + time.Duration(rand.Int63n(half+1))
+	}
+	return delay
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveFlakyGit serves a bare copy of a source repository over smart HTTP at
+// <url>/test/source.git, with git http-backend behind a handler that answers
+// the first failures requests with the given status instead
+func serveFlakyGit(t *testing.T, failures int32, status int) (string, *atomic.Int32) {
+	t.Helper()
+	source := createSourceRepository(t)
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skipf("git --exec-path failed: %v", err)
+	}
+	backend := filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend")
+
+	root := t.TempDir()
+	runGit(t, root, "clone", "--quiet", "--bare", source, filepath.Join(root, "test", "source.git"))
+
+	git := &cgi.Handler{
+		Path:   backend,
+		Env:    []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+		Stderr: io.Discard,
+	}
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		git.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	// Never wait for credentials on a 401
+	t.Setenv("GIT_TERMINAL_PROMPT", "0")
+	return server.URL, &requests
+}
+
+func withRetryPolicy(t *testing.T, policy retryPolicy) {
+	t.Helper()
+	saved := defaultRetryPolicy
+	defaultRetryPolicy = policy
+	t.Cleanup(func() { defaultRetryPolicy = saved })
+}
+
+func TestMirrorRepositoryRetriesTransientErrors(t *testing.T) {
+	serverURL, requests := serveFlakyGit(t, 2, http.StatusServiceUnavailable)
+	withRetryPolicy(t, retryPolicy{Retries: 3, Delay: time.Millisecond})
+	mirrorsDir := t.TempDir()
+	repo := Repository{Provider: "local", Owner: "test", Name: "source", URL: serverURL + "/test/source.git"}
+
+	result := mirrorRepository(context.Background(), mirrorsDir, repo)
+	if result.Action != resultCloned || result.Attempts != 3 {
+		t.Fatalf("mirrorRepository() = %+v, want a clone after 3 attempts", result)
+	}
+
+	// Updates are retried as well
+	requests.Store(1)
+	if result := mirrorRepository(context.Background(), mirrorsDir, repo); result.Action != resultUnchanged || result.Attempts != 2 {
+		t.Errorf("mirrorRepository() of the mirror = %+v, want unchanged after 2 attempts", result)
+	}
+}
+
+func TestMirrorRepositoryGivesUpAfterRetries(t *testing.T) {
+	serverURL, _ := serveFlakyGit(t, 100, http.StatusTooManyRequests)
+	withRetryPolicy(t, retryPolicy{Retries: 3, Delay: time.Hour})
+	retries := 1
+	repo := Repository{
+		Provider: "local", Owner: "test", Name: "source", URL: serverURL + "/test/source.git",
+		Options: &RepositoryOptions{Retries: &retries, RetryDelay: time.Millisecond},
+	}
+
+	result := mirrorRepository(context.Background(), t.TempDir(), repo)
+	if result.Succeeded() || result.Category != categoryTransient || result.Attempts != 2 {
+		t.Errorf("mirrorRepository() = %+v, want a transient failure after 2 attempts", result)
+	}
+}
+
+func TestMirrorRepositoryDoesNotRetryPermanentErrors(t *testing.T) {
+	withRetryPolicy(t, retryPolicy{Retries: 3, Delay: time.Hour})
+	tests := []struct {
+		status   int
+		path     string
+		category string
+	}{
+		{http.StatusUnauthorized, "/test/source.git", categoryAuth},
+		{http.StatusForbidden, "/test/source.git", categoryAuth},
+		{http.StatusNotFound, "/test/source.git", categoryNotFound},
+		{http.StatusOK, "/test/missing.git", categoryNotFound},
+	}
+
+	for _, tt := range tests {
+		failures := int32(100)
+		if tt.status == http.StatusOK {
+			failures = 0
+		}
+		serverURL, _ := serveFlakyGit(t, failures, tt.status)
+		repo := Repository{Provider: "local", Owner: "test", Name: "source", URL: serverURL + tt.path}
+
+		result := mirrorRepository(context.Background(), t.TempDir(), repo)
+		if result.Succeeded() || result.Category != tt.category || result.Attempts != 1 {
+			t.Errorf("mirrorRepository() with status %d on %s = %+v, want a %s failure after 1 attempt", tt.status, tt.path, result, tt.category)
+		}
+	}
+}
+
+func TestClassifyGitError(t *testing.T) {
+	tests := []struct {
+		stderr   string
+		expected string
+	}{
+		{"fatal: unable to access 'https://github.com/a/b.git/': The requested URL returned error: 503", categoryTransient},
+		{"fatal: unable to access 'https://github.com/a/b.git/': The requested URL returned error: 429", categoryTransient},
+		{"fatal: unable to access 'https://github.com/a/b.git/': Could not resolve host: github.com", categoryTransient},
+		{"error: RPC failed; curl 18 transfer closed with outstanding read data remaining\nfatal: early EOF\nfatal: index-pack failed", categoryTransient},
+		{"ssh: connect to host github.com port 22: Connection timed out\nfatal: Could not read from remote repository.", categoryTransient},
+		{"fatal: could not read Username for 'https://github.com': terminal prompts disabled", categoryAuth},
+		{"remote: HTTP Basic: Access denied\nfatal: Authentication failed for 'https://gitlab.com/a/b.git/'", categoryAuth},
+		{"git@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository.", categoryAuth},
+		{"remote: Repository not found.\nfatal: repository 'https://github.com/a/b.git/' not found", categoryNotFound},
+		{"fatal: '/srv/missing' does not appear to be a git repository", categoryNotFound},
+		{"error: object file objects/ab/cdef is empty\nfatal: loose object abcdef (stored in objects/ab/cdef) is corrupt", categoryCorruption},
+		{"fatal: bad object refs/heads/main\nerror: github.com:a/b.git did not send all necessary objects", categoryCorruption},
+		{"error: cannot lock ref 'refs/heads/main'", categoryGit},
+		{"", categoryGit},
+	}
+
+	for _, tt := range tests {
+		if got := classifyGitError(tt.stderr); got != tt.expected {
+			t.Errorf("classifyGitError(%q) = %s, want %s", tt.stderr, got, tt.expected)
+		}
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := retryPolicy{Retries: 10, Delay: time.Second}
+	for attempt, base := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 20: maxRetryDelay} {
+		for i := 0; i < 20; i++ {
+			if delay := policy.backoff(attempt); delay < base/2 || delay > base {
+				t.Errorf("backoff(%d) = %s, want between %s and %s", attempt, delay, base/2, base)
+			}
+		}
+	}
+
+	retries := 0
+	repo := Repository{Options: &RepositoryOptions{Retries: &retries}}
+	if got := repositoryRetryPolicy(repo); got.Retries != 0 || got.Delay != defaultRetryPolicy.Delay {
+		t.Errorf("repositoryRetryPolicy() = %+v, want no retries with the default delay", got)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// hostAliases maps host names to providers for serve, so that a mirror host
+// can answer GitHub-style paths like /torvalds/linux.git. It is set with
+// -alias host=provider.
+type hostAliases map[string]string
+
+func (a hostAliases) String() string {
+	var aliases []string
+	for host, provider := range a {
+		aliases = append(aliases, host+"="+provider)
+	}
+	return strings.Join(aliases, ",")
+}
+
+func (a hostAliases) Set(value string) error {
+	host, provider, found := strings.Cut(value, "=")
+	if !found || host == "" || provider == "" {
+		return fmt.Errorf("expected host=provider, got %q", value)
+	}
+	a[strings.ToLower(host)] = provider
+	return nil
+}
+
+// gitServer serves the mirrors of the registry over the smart HTTP and git
+// daemon protocols. It only runs upload-pack, so mirrors can be cloned and
+// fetched but never pushed to.
+type gitServer struct {
+	mirrorsDir string
+	exports    *mirrorExports
+	aliases    hostAliases
+	// goproxy enables the Go module proxy protocol over HTTP
+	goproxy bool
+	// web enables the web interface over HTTP
+	web bool
+	// lockTimeout is how long a request waits for a sync or gc of its
+	// mirror to finish
+	lockTimeout time.Duration
+}
+
+// gitProtocolHeader matches the Git-Protocol values passed on to upload-pack,
+// like "version=2"
+var gitProtocolHeader = regexp.MustCompile(`^[a-zA-Z0-9=:.-]*$`)
+
+func (s *gitServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.goproxy && isGoProxyPath(r.URL.Path) {
+		s.serveGoProxy(w, r)
+		return
+	}
+
+	repoPath, service, found := cutGitService(r.URL.Path)
+	if !found && s.web {
+		s.serveWeb(w, r)
+		return
+	} else if !found {
+		http.NotFound(w, r)
+		return
+	}
+	if service == "info/refs" {
+		service = r.URL.Query().Get("service")
+	}
+	switch service {
+	case "git-upload-pack":
+	case "git-receive-pack":
+		http.Error(w, "Pushing is not supported, mirrors are read-only", http.StatusForbidden)
+		return
+	default:
+		// Dumb HTTP clients would read the repository files directly
+		http.Error(w, "Only the smart HTTP protocol is supported", http.StatusForbidden)
+		return
+	}
+
+	repo, ok := s.resolve(r.Host, repoPath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	lock, err := s.lock(r.Context(), repo)
+	if err != nil {
+		log.Printf("Warning: %s: %v", repoPath, err)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "The mirror is being updated, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer lock.release()
+
+	repoDir := repositoryDir(s.mirrorsDir, repo)
+	if r.Method == http.MethodGet {
+		s.advertiseRefs(w, r, repoDir)
+	} else if r.Method == http.MethodPost {
+		s.uploadPack(w, r, repoDir)
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// cutGitService splits a request path into the repository path and the smart
+// HTTP endpoint: info/refs, git-upload-pack or git-receive-pack
+func cutGitService(urlPath string) (string, string, bool) {
+	for _, service := range []string{"info/refs", "git-upload-pack", "git-receive-pack"} {
+		if repoPath, found := strings.CutSuffix(urlPath, "/"+service); found {
+			return strings.Trim(repoPath, "/"), service, repoPath != ""
+		}
+	}
+	return "", "", false
+}
+
+// advertiseRefs answers the first request of a fetch with the refs of the
+// mirror, or the capabilities of upload-pack with protocol v2
+func (s *gitServer) advertiseRefs(w http.ResponseWriter, r *http.Request, repoDir string) {
+	cmd := s.uploadPackCommand(r, repoDir, "--advertise-refs")
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	setNoCache(w)
+
+	// Protocol v2 starts with the capabilities, older ones with the service
+	if !strings.Contains(r.Header.Get("Git-Protocol"), "version=2") {
+		io.WriteString(w, pktLine("# service=git-upload-pack\n")+"0000")
+	}
+	cmd.Stdout = w
+	if stderr, err := runCommand(cmd); err != nil {
+		log.Printf("Warning: upload-pack of %s failed: %v: %s", repoDir, err, lastLine(stderr))
+	}
+}
+
+// uploadPack answers the negotiation and pack requests of a fetch
+func (s *gitServer) uploadPack(w http.ResponseWriter, r *http.Request, repoDir string) {
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid gzip request body", http.StatusBadRequest)
+			return
+		}
+		defer reader.Close()
+		body = reader
+	}
+
+	cmd := s.uploadPackCommand(r, repoDir)
+	cmd.Stdin = body
+	cmd.Stdout = w
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	setNoCache(w)
+	if stderr, err := runCommand(cmd); err != nil {
+		log.Printf("Warning: upload-pack of %s failed: %v: %s", repoDir, err, lastLine(stderr))
+	}
+}
+
+// uploadPackCommand builds a stateless git upload-pack command for a request,
+// passing on the protocol version asked for by the client
+func (s *gitServer) uploadPackCommand(r *http.Request, repoDir string, args ...string) *exec.Cmd {
+	args = append([]string{"upload-pack", "--stateless-rpc", "--strict"}, args...)
+	cmd := exec.CommandContext(r.Context(), "git", append(args, repoDir)...)
+	if protocol := r.Header.Get("Git-Protocol"); protocol != "" && gitProtocolHeader.MatchString(protocol) {
+		cmd.Env = append(os.Environ(), "GIT_PROTOCOL="+protocol)
+	}
+	return cmd
+}
+
+// mirrorExports indexes the repositories of the registry by the path of
+// their mirror in the mirrors directory, which is all serve ever exposes
+type mirrorExports struct {
+	mirrorsDir string
+	repos      []Repository
+	byPath     map[string]Repository
+	// byFoldedPath holds the lowercase paths of the repositories of providers
+	// that ignore case
+	byFoldedPath map[string]Repository
+}
+
+func newMirrorExports(mirrorsDir string, repos []Repository) *mirrorExports {
+	exports := &mirrorExports{
+		mirrorsDir:   mirrorsDir,
+		byPath:       make(map[string]Repository),
+		byFoldedPath: make(map[string]Repository),
+	}
+	for _, repo := range repos {
+		rel, err := filepath.Rel(mirrorsDir, repositoryDir(mirrorsDir, repo))
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		path := filepath.ToSlash(rel)
+		exports.repos = append(exports.repos, repo)
+		exports.byPath[path] = repo
+		if caseInsensitiveKinds[providers[repo.Provider].Kind] {
+			exports.byFoldedPath[strings.ToLower(path)] = repo
+		}
+	}
+	return exports
+}
+
+// lookup returns the repository whose mirror is at path, a slash-separated
+// path relative to the mirrors directory
+func (e *mirrorExports) lookup(path string) (Repository, bool) {
+	if repo, ok := e.byPath[path]; ok {
+		return repo, true
+	}
+	repo, ok := e.byFoldedPath[strings.ToLower(path)]
+	return repo, ok
+}
+
+// resolve returns the repository of a request path, which is the path of its
+// mirror in the mirrors directory, with or without .git. On a host standing
+// for a provider, the path may leave out the provider, like on the provider
+// itself. Only mirrors of the registry that exist on disk are found.
+func (s *gitServer) resolve(host, repoPath string) (Repository, bool) {
+	segments := strings.Split(strings.Trim(repoPath, "/"), "/")
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return Repository{}, false
+		}
+	}
+
+	var candidates [][]string
+	if provider := s.hostProvider(host); provider != "" && !strings.EqualFold(segments[0], provider) {
+		candidates = append(candidates, append([]string{provider}, segments...))
+	}
+	candidates = append(candidates, segments)
+
+	for _, candidate := range candidates {
+		last := len(candidate) - 1
+		for _, name := range []string{strings.TrimSuffix(candidate[last], ".git"), candidate[last]} {
+			path := strings.Join(append(candidate[:last:last], name), "/")
+			repo, ok := s.exports.lookup(path)
+			if ok && mirrorExists(repositoryDir(s.mirrorsDir, repo)) {
+				return repo, true
+			}
+		}
+	}
+	return Repository{}, false
+}
+
+// hostProvider returns the provider a request host stands for: an alias
+// given with -alias, the host of the provider itself, or a host named after
+// it like github.mirror.example, in that order of precedence
+func (s *gitServer) hostProvider(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.ToLower(host)
+	if provider, ok := s.aliases[host]; ok {
+		return provider
+	}
+	if name, ok := providerForHost(host); ok {
+		return name
+	}
+	label, _, found := strings.Cut(host, ".")
+	if _, ok := providers[label]; ok && found {
+		return label
+	}
+	return ""
+}
+
+// lock takes the shared lock of the mirror of repo, waiting up to lockTimeout
+// for a sync or gc of it to finish
+func (s *gitServer) lock(ctx context.Context, repo Repository) (*fileLock, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.lockTimeout)
+	defer cancel()
+	return lockRepository(ctx, s.mirrorsDir, repo, false, "serve")
+}
+
+// pktLine encodes data as a git pkt-line
+func pktLine(data string) string {
+	return fmt.Sprintf("%04x%s", len(data)+4, data)
+}
+
+func setNoCache(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+}
+
+// runServe implements the serve command, which serves the mirrors of the
+// registry read-only over HTTP and optionally git:// until interrupted
+func runServe(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	common := addRegistryFlags(flags)
+	common.addMirrorsFlag(flags)
+	var listen = flags.String("listen", "localhost:8080", "Address to listen on for HTTP (empty to disable HTTP)")
+	var gitDaemon = flags.Bool("git-daemon", false, "Also serve the git:// protocol")
+	var goproxy = flags.Bool("goproxy", false, "Also serve the Go module proxy protocol over HTTP, for GOPROXY")
+	var web = flags.Bool("web", false, "Also serve a web interface to browse the mirrors over HTTP")
+	var daemonListen = flags.String("git-daemon-listen", fmt.Sprintf(":%d", DefaultDaemonPort), "Address to listen on for git://")
+	aliases := hostAliases{}
+	flags.Var(aliases, "alias", "Serve the paths of a provider without its prefix on a host, as host=provider (repeatable)")
+	var lockTimeout = flags.Duration("lock-timeout", time.Minute, "How long a request waits for a sync or gc of its mirror to finish")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s serve [flags]\n\n", AppName)
+		fmt.Fprintln(flags.Output(), "Serves the mirrors of the registry read-only over the git smart HTTP and git:// protocols, as a Go module proxy, and as web pages.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		exitf(exitConfigError, "Failed to parse arguments: %v", err)
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(exitConfigError)
+	}
+	if *listen == "" && !*gitDaemon {
+		exitf(exitConfigError, "Nothing to serve: -listen is empty and -git-daemon is not set")
+	}
+	if *listen == "" && (*goproxy || *web) {
+		exitf(exitConfigError, "Failed to parse arguments: -goproxy and -web need -listen")
+	}
+
+	registryFile, mirrorsDir := common.load()
+	repos, err := readRegistry(registryFile)
+	if err != nil {
+		exitf(exitRegistryError, "Failed to read registry: %v", err)
+	}
+	server := &gitServer{
+		mirrorsDir:  mirrorsDir,
+		exports:     newMirrorExports(mirrorsDir, repos),
+		aliases:     aliases,
+		goproxy:     *goproxy,
+		web:         *web,
+		lockTimeout: *lockTimeout,
+	}
+
+	ctx, stop := notifyContext(context.Background())
+	defer stop()
+
+	errs := make(chan error, 2)
+	serving := 0
+	if *listen != "" {
+		listener, err := net.Listen("tcp", *listen)
+		if err != nil {
+			exitf(exitConfigError, "Failed to listen: %v", err)
+		}
+		httpServer := &http.Server{Handler: server, ReadHeaderTimeout: 30 * time.Second}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_ = httpServer.Shutdown(shutdownCtx)
+		}()
+		go func() {
+			if err := httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				errs <- err
+				return
+			}
+			errs <- nil
+		}()
+		serving++
+		fmt.Printf("Serving %d repositories of %s on http://%s\n", len(repos), mirrorsDir, listener.Addr())
+	}
+	if *gitDaemon {
+		listener, err := net.Listen("tcp", *daemonListen)
+		if err != nil {
+			exitf(exitConfigError, "Failed to listen: %v", err)
+		}
+		go func() { errs <- server.serveDaemon(ctx, listener) }()
+		serving++
+		fmt.Printf("Serving %d repositories of %s on git://%s\n", len(repos), mirrorsDir, listener.Addr())
+	}
+
+	for range serving {
+		if err := <-errs; err != nil {
+			exitf(exitConfigError, "Failed to serve: %v", err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// serveMirrors mirrors a source repository as local/test/source,
+// github/Torvalds/linux and local/test/unlisted, and serves the first two
+// with the host of the listener aliased to github
+func serveMirrors(t *testing.T) (*gitServer, string) {
+	t.Helper()
+	source := createSourceRepository(t)
+	mirrorsDir := t.TempDir()
+	repos := []Repository{
+		{Provider: "local", Owner: "test", Name: "source", URL: source},
+		{Provider: "github", Owner: "Torvalds", Name: "linux", URL: source},
+		{Provider: "local", Owner: "test", Name: "unlisted", URL: source},
+	}
+	for _, repo := range repos {
+		if result := mirrorRepository(context.Background(), mirrorsDir, repo); !result.Succeeded() {
+			t.Fatalf("mirrorRepository() = %+v, want success", result)
+		}
+	}
+
+	server := &gitServer{
+		mirrorsDir:  mirrorsDir,
+		exports:     newMirrorExports(mirrorsDir, repos[:2]),
+		aliases:     hostAliases{"127.0.0.1": "github"},
+		lockTimeout: time.Second,
+	}
+	listener := httptest.NewServer(server)
+	t.Cleanup(listener.Close)
+	return server, listener.URL
+}
+
+func TestServeClone(t *testing.T) {
+	_, url := serveMirrors(t)
+
+	tests := []struct {
+		path     string
+		protocol string
+	}{
+		{"/local/test/source.git", "2"},
+		{"/local/test/source", "0"},
+		{"/github/torvalds/linux.git", "2"},
+		{"/torvalds/linux.git", "1"},
+		{"/Torvalds/Linux", "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+" v"+tt.protocol, func(t *testing.T) {
+			dir := t.TempDir()
+			runGit(t, dir, "-c", "protocol.version="+tt.protocol, "clone", "--quiet", url+tt.path, "clone")
+			if tag := runGit(t, filepath.Join(dir, "clone"), "tag"); tag != "v1.0.0" {
+				t.Errorf("cloned tags = %q, want v1.0.0", tag)
+			}
+		})
+	}
+}
+
+func TestServeRejects(t *testing.T) {
+	server, url := serveMirrors(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"push refs", "GET", "/local/test/source.git/info/refs?service=git-receive-pack", http.StatusForbidden},
+		{"push", "POST", "/local/test/source.git/git-receive-pack", http.StatusForbidden},
+		{"dumb protocol", "GET", "/local/test/source.git/info/refs", http.StatusForbidden},
+		{"repository files", "GET", "/local/test/source.git/HEAD", http.StatusNotFound},
+		{"missing repository", "GET", "/local/test/missing.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"repository outside the registry", "GET", "/local/test/unlisted.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"parent directory", "GET", "/local/test/../test/source.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+		{"lock directory", "GET", "/.locks/local/test/source.git/info/refs?service=git-upload-pack", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest(tt.method, url+tt.path, nil))
+			if recorder.Code != tt.status {
+				t.Errorf("%s %s status = %d, want %d", tt.method, tt.path, recorder.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestServeWaitsForSync(t *testing.T) {
+	server, url := serveMirrors(t)
+	repo := Repository{Provider: "local", Owner: "test", Name: "source"}
+	held, err := tryLock(repositoryLockPath(server.mirrorsDir, repo), true, "sync")
+	if err != nil {
+		t.Fatalf("tryLock() unexpected error: %v", err)
+	}
+	defer held.release()
+
+	server.lockTimeout = 200 * time.Millisecond
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("GET", url+"/local/test/source.git/info/refs?service=git-upload-pack", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("status during a sync = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHostProvider(t *testing.T) {
+	server := &gitServer{aliases: hostAliases{"mirror.example": "gitlab"}}
+	tests := map[string]string{
+		"mirror.example:8080":     "gitlab",
+		"MIRROR.example":          "gitlab",
+		"github.com":              "github",
+		"github.mirror.example":   "github",
+		"localhost:8080":          "",
+		"codeberg.mirror.example": "",
+	}
+	for host, expected := range tests {
+		if provider := server.hostProvider(host); provider != expected {
+			t.Errorf("hostProvider(%q) = %q, want %q", host, provider, expected)
+		}
+	}
+}
+
+// TestHostProviderPrecedence checks that the host of a provider wins over a
+// host named after another provider, whatever the order of the providers
+func TestHostProviderPrecedence(t *testing.T) {
+	withProviders(t, map[string]Provider{"corp": {Kind: "gitlab", Host: "gitlab.corp.example"}})
+	server := &gitServer{}
+	for range 20 {
+		if provider := server.hostProvider("gitlab.corp.example"); provider != "corp" {
+			t.Fatalf("hostProvider() = %q, want corp", provider)
+		}
+	}
+	if provider := server.hostProvider("gitlab.mirror.example"); provider != "gitlab" {
+		t.Errorf("hostProvider() = %q, want gitlab", provider)
+	}
+}
+
+func TestMirrorExports(t *testing.T) {
+	mirrorsDir := filepath.Join(t.TempDir(), "mirrors")
+	exports := newMirrorExports(mirrorsDir, []Repository{
+		{Provider: "github", Owner: "Torvalds", Name: "linux"},
+		{Provider: "local", Owner: "Team", Name: "Tools"},
+		{Provider: "github", Owner: "golang", Name: "go", Options: &RepositoryOptions{Path: "go/go"}},
+	})
+
+	tests := map[string]string{
+		"github/Torvalds/linux": "Torvalds/linux",
+		"github/torvalds/LINUX": "Torvalds/linux",
+		"local/Team/Tools":      "Team/Tools",
+		"local/team/tools":      "",
+		"go/go":                 "golang/go",
+		"github/golang/go":      "",
+	}
+	for path, expected := range tests {
+		repo, ok := exports.lookup(path)
+		if name := repo.Owner + "/" + repo.Name; ok != (expected != "") || (ok && name != expected) {
+			t.Errorf("lookup(%q) = %s, %v, want %q", path, name, ok, expected)
+		}
+	}
+}
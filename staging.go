@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stagingMarker is in the name of the staging directories of clones, which
+// are hidden siblings of the mirror directory like .linux.staging-123456
+const stagingMarker = ".staging-"
+
+// createStagingDir creates an empty staging directory next to repoDir, on the
+// same file system so that the finished clone can be renamed into place
+func createStagingDir(repoDir string) (string, error) {
+	return os.MkdirTemp(filepath.Dir(repoDir), "."+filepath.Base(repoDir)+stagingMarker)
+}
+
+// isStagingDir reports whether name is the name of a staging directory
+func isStagingDir(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, stagingMarker)
+}
+
+// verifyMirror checks that a fresh clone is a bare mirror whose refs all
+// point to complete histories
+func verifyMirror(ctx context.Context, repoDir string) (string, error) {
+	if !mirrorExists(repoDir) {
+		return "", errors.New("no refs directory")
+	}
+	return runGitCommand(ctx, Repository{}, repoDir, "-C", repoDir, "fsck", "--connectivity-only", "--progress")
+}
+
+// publishMirror renames a verified staging directory to repoDir. An empty
+// directory in the way is replaced, anything else is left alone.
+func publishMirror(stagingDir, repoDir string) error {
+	if err := os.Remove(repoDir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s is in the way: %w", repoDir, err)
+	}
+	return os.Rename(stagingDir, repoDir)
+}
+
+// cleanStagingDirs removes the staging directories left in mirrorsDir by the
+// clones of runs that crashed or were killed, and returns their paths
+func cleanStagingDirs(mirrorsDir string) ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(mirrorsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == mirrorsDir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if !d.IsDir() || path == mirrorsDir {
+			return nil
+		}
+		if isStagingDir(d.Name()) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			removed = append(removed, path)
+			return fs.SkipDir
+		}
+		// Mirrors hold no staging directories, and are too large to walk
+		if strings.HasPrefix(d.Name(), ".") || mirrorExists(path) {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return removed, err
+}
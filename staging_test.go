@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCloneRepositoryStaging(t *testing.T) {
+	source := createSourceRepository(t)
+	mirrorsDir := t.TempDir()
+	ownerDir := filepath.Join(mirrorsDir, "local", "test")
+
+	missing := Repository{Provider: "local", Owner: "test", Name: "missing", URL: filepath.Join(t.TempDir(), "missing")}
+	if result := cloneRepository(context.Background(), mirrorsDir, missing); result.Succeeded() {
+		t.Fatalf("cloneRepository() of a missing remote = %+v, want a failure", result)
+	}
+	if names := dirNames(t, ownerDir); len(names) != 0 {
+		t.Errorf("failed clone left %v behind", names)
+	}
+
+	// An empty directory in the way is replaced
+	repo := Repository{Provider: "local", Owner: "test", Name: "source", URL: source}
+	if err := os.MkdirAll(filepath.Join(ownerDir, "source"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if result := cloneRepository(context.Background(), mirrorsDir, repo); result.Action != resultCloned {
+		t.Fatalf("cloneRepository() = %+v, want a clone", result)
+	}
+	if names := dirNames(t, ownerDir); !reflect.DeepEqual(names, []string{"source"}) {
+		t.Errorf("directory after a clone holds %v, want only the mirror", names)
+	}
+	if !mirrorExists(filepath.Join(ownerDir, "source")) {
+		t.Errorf("clone was not moved into place")
+	}
+}
+
+func TestPublishMirrorKeepsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	staging, repoDir := filepath.Join(dir, ".repo.staging-1"), filepath.Join(dir, "repo")
+	for _, path := range []string{staging, repoDir} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(repoDir, "notes.txt"), []byte("keep\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if err := publishMirror(staging, repoDir); err == nil {
+		t.Errorf("publishMirror() over a non-empty directory should fail")
+	}
+	if _, err := os.Stat(filepath.Join(repoDir, "notes.txt")); err != nil {
+		t.Errorf("publishMirror() should keep the files in the way: %v", err)
+	}
+}
+
+func TestVerifyMirror(t *testing.T) {
+	source := createSourceRepository(t)
+	dir := t.TempDir()
+
+	if _, err := verifyMirror(context.Background(), dir); err == nil {
+		t.Errorf("verifyMirror() of an empty directory should fail")
+	}
+
+	mirror := filepath.Join(dir, "mirror")
+	runGit(t, dir, "clone", "--quiet", "--mirror", source, mirror)
+	if stderr, err := verifyMirror(context.Background(), mirror); err != nil {
+		t.Errorf("verifyMirror() of a complete mirror: %v: %s", err, stderr)
+	}
+
+	// A ref to a missing commit
+	ref := filepath.Join(mirror, "refs", "heads", "broken")
+	if err := os.WriteFile(ref, []byte(strings.Repeat("1", 40)+"\n"), 0644); err != nil {
+		t.Fatalf("Failed to write ref: %v", err)
+	}
+	if _, err := verifyMirror(context.Background(), mirror); err == nil {
+		t.Errorf("verifyMirror() of a mirror with a broken ref should fail")
+	}
+}
+
+func TestCleanStagingDirs(t *testing.T) {
+	mirrorsDir := t.TempDir()
+	for _, dir := range []string{
+		"github/golang/.go.staging-123/objects",
+		"github/golang/tools/refs",
+		"github/golang/tools/objects/.x.staging-1",
+		"gitlab/group/sub/.project.staging-456",
+		"github/.cache",
+	} {
+		if err := os.MkdirAll(filepath.Join(mirrorsDir, filepath.FromSlash(dir)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+
+	removed, err := cleanStagingDirs(mirrorsDir)
+	if err != nil {
+		t.Fatalf("cleanStagingDirs() unexpected error: %v", err)
+	}
+	expected := []string{
+		filepath.Join(mirrorsDir, "github", "golang", ".go.staging-123"),
+		filepath.Join(mirrorsDir, "gitlab", "group", "sub", ".project.staging-456"),
+	}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("cleanStagingDirs() = %v, want %v", removed, expected)
+	}
+	for _, kept := range []string{"github/golang/tools/objects/.x.staging-1", "github/.cache"} {
+		if _, err := os.Stat(filepath.Join(mirrorsDir, filepath.FromSlash(kept))); err != nil {
+			t.Errorf("cleanStagingDirs() should keep %s: %v", kept, err)
+		}
+	}
+
+	if removed, err := cleanStagingDirs(filepath.Join(mirrorsDir, "missing")); err != nil || len(removed) != 0 {
+		t.Errorf("cleanStagingDirs() of a missing directory = %v, %v", removed, err)
+	}
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
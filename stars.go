@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+)
+
+// listStarredRepositories returns the "owner/name" paths of the repositories
+// starred by a user, following pagination
+func listStarredRepositories(provider Provider, user string) ([]string, error) {
+	api, err := provider.apiURL()
+	if err != nil {
+		return nil, err
+	}
+
+	var starredURL string
+	switch provider.Kind {
+	case "github":
+		starredURL = api + "/users/" + url.PathEscape(user) + "/starred?per_page=100"
+	case "gitea":
+		starredURL = api + "/users/" + url.PathEscape(user) + "/starred?limit=50"
+	default:
+		return nil, fmt.Errorf("importing stars is not supported for %s providers", provider.Kind)
+	}
+
+	var paths []string
+	err = fetchPages(provider, starredURL, func(data []byte) (string, error) {
+		var page []struct {
+			FullName string `json:"full_name"`
+		}
+		err := json.Unmarshal(data, &page)
+		for _, r := range page {
+			paths = append(paths, r.FullName)
+		}
+		return "", err
+	})
+	return paths, err
+}
+
+// errListStars is the failure to list the stars of a user through the
+// provider API, as opposed to a failure to read or update the registry
+var errListStars = errors.New("failed to list stars")
+
+// importStars appends the repositories starred by user on the named provider
+// to the registry file, skipping those already listed. Plain-text registries
+// keep their content as is and get a new commented group at the end.
+func importStars(registryFile, providerName, user string) (added []string, skipped int, err error) {
+	provider, ok := providers[providerName]
+	if !ok {
+		return nil, 0, fmt.Errorf("unsupported provider: %s", providerName)
+	}
+
+	paths, err := listStarredRepositories(provider, user)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errListStars, err)
+	}
+
+	entries, err := readRegistryEntries(registryFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, err
+	}
+
+	// Stars are compared by mirror directory with the whole registry, its
+	// included files and expanded owner patterns too, so that a URL entry
+	// and the short form of the same repository count as one
+	loader := &registryLoader{}
+	if len(entries) > 0 {
+		if err := loader.loadFile(registryFile); err != nil {
+			return nil, 0, err
+		}
+	}
+	present := make(map[string]bool)
+	for _, repo := range loader.repos {
+		present[mirrorKey(repo.Repository)] = true
+	}
+
+	for _, repoPath := range paths {
+		line := providerName + ":" + repoPath
+		repo, err := parseRepositoryLine(line)
+		if err != nil {
+			return nil, 0, fmt.Errorf("unexpected repository %s: %v", repoPath, err)
+		}
+		key := mirrorKey(repo)
+		// An excluded star would be excluded again once added
+		if present[key] || isExcluded(repo, loader.excludes) {
+			skipped++
+			continue
+		}
+		present[key] = true
+		added = append(added, line)
+	}
+
+	if len(added) == 0 {
+		return nil, skipped, nil
+	}
+
+	comment := fmt.Sprintf("Starred by %s on %s", user, providerName)
+	if err := appendRegistryEntries(registryFile, entries, added, comment); err != nil {
+		return nil, 0, err
+	}
+	return added, skipped, nil
+}
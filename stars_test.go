@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImportStars(t *testing.T) {
+	withProviderAPI(t)
+
+	content := `# Go
+github:golang/go
+
+# Kernel
+https://github.com/torvalds/linux.git`
+	registryFile := filepath.Join(t.TempDir(), "registry.txt")
+	if err := os.WriteFile(registryFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	added, skipped, err := importStars(registryFile, "github", "octocat")
+	if err != nil {
+		t.Fatalf("importStars() unexpected error: %v", err)
+	}
+	if fmt.Sprint(added) != "[github:NixOS/nixpkgs]" || skipped != 2 {
+		t.Errorf("importStars() = %v, %d, want [github:NixOS/nixpkgs], 2", added, skipped)
+	}
+
+	result, err := os.ReadFile(registryFile)
+	if err != nil {
+		t.Fatalf("Failed to read registry: %v", err)
+	}
+	expected := content + "\n\n# Starred by octocat on github\ngithub:NixOS/nixpkgs\n"
+	if string(result) != expected {
+		t.Errorf("registry content = %q, want %q", result, expected)
+	}
+
+	// A second import finds everything already present
+	added, skipped, err = importStars(registryFile, "github", "octocat")
+	if err != nil {
+		t.Fatalf("second importStars() unexpected error: %v", err)
+	}
+	if len(added) != 0 || skipped != 3 {
+		t.Errorf("second importStars() = %v, %d, want nothing added and 3 skipped", added, skipped)
+	}
+}
+
+// TestImportStarsIncludesAndPatterns skips the stars listed by an included
+// file or an owner pattern, which a second listing would make duplicates
+func TestImportStarsIncludesAndPatterns(t *testing.T) {
+	withProviderAPI(t)
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "teams"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "teams", "go.txt"), []byte("https://github.com/golang/go\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	registryFile := filepath.Join(dir, "registry.txt")
+	if err := os.WriteFile(registryFile, []byte("@include teams/go.txt\ngithub:NixOS/*\n"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	added, skipped, err := importStars(registryFile, "github", "octocat")
+	if err != nil {
+		t.Fatalf("importStars() unexpected error: %v", err)
+	}
+	if fmt.Sprint(added) != "[github:torvalds/linux]" || skipped != 2 {
+		t.Errorf("importStars() = %v, %d, want [github:torvalds/linux], 2", added, skipped)
+	}
+
+	if _, err := loadRegistry(registryFile, true); err != nil {
+		t.Errorf("loadRegistry() in strict mode after the import: %v", err)
+	}
+}
+
+func TestImportStarsStructuredRegistry(t *testing.T) {
+	withProviderAPI(t)
+
+	registryFile := filepath.Join(t.TempDir(), "registry.json")
+	content := `{"repositories": [{"repo": "github:golang/go", "labels": ["go"]}]}`
+	if err := os.WriteFile(registryFile, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	if _, _, err := importStars(registryFile, "gitea", "john"); err != nil {
+		t.Fatalf("importStars() unexpected error: %v", err)
+	}
+
+	repos, err := readRegistry(registryFile)
+	if err != nil {
+		t.Fatalf("readRegistry() unexpected error: %v", err)
+	}
+	expected := []string{"gitea:gitea/tea", "github:golang/go"}
+	if paths := repositoryPaths(repos); fmt.Sprint(paths) != fmt.Sprint(expected) {
+		t.Errorf("readRegistry() = %v, want %v", paths, expected)
+	}
+	if repos[0].Options == nil || repos[0].Options.Labels[0] != "go" {
+		t.Errorf("existing entry lost its options: %+v", repos[0])
+	}
+}
+
+func TestImportStarsUnsupportedProvider(t *testing.T) {
+	registryFile := filepath.Join(t.TempDir(), "registry.txt")
+	if _, _, err := importStars(registryFile, "azure", "someone"); err == nil {
+		t.Error("importStars() expected error for a provider without stars")
+	}
+	if _, _, err := importStars(registryFile, "codeberg", "someone"); err == nil {
+		t.Error("importStars() expected error for an unknown provider")
+	}
+}
+
+func TestImportStarsListingError(t *testing.T) {
+	withProviderAPI(t)
+	registryFile := filepath.Join(t.TempDir(), "registry.txt")
+
+	// The stand-in API knows nothing of this user
+	if _, _, err := importStars(registryFile, "github", "nobody"); !errors.Is(err, errListStars) {
+		t.Errorf("importStars() = %v, want a listing error", err)
+	}
+}
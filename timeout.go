@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// errStalled is the cause of a git command killed by the stall detector
+var errStalled = errors.New("stalled")
+
+// stopError is the cause of a sync stopped early. It reads as the reason it
+// was stopped, and matches the context error it stands for.
+type stopError struct {
+	reason string
+	err    error
+}
+
+func (e *stopError) Error() string {
+	return e.reason
+}
+
+func (e *stopError) Unwrap() error {
+	return e.err
+}
+
+// stallTimeout is how long a git command may go without receiving data before
+// it is killed, set by the -stall-timeout flag of sync. Zero disables the
+// stall detector.
+var stallTimeout = 10 * time.Minute
+
+// defaultRepositoryTimeout bounds the sync of the repositories without a
+// timeout of their own, set by the -repo-timeout flag of sync. Zero means no
+// timeout.
+var defaultRepositoryTimeout time.Duration
+
+// repositoryTimeout returns how long the sync of repo may take, retries
+// included, where its structured registry setting overrides the default one
+func repositoryTimeout(repo Repository) time.Duration {
+	if repo.Options != nil && repo.Options.Timeout > 0 {
+		return repo.Options.Timeout
+	}
+	return defaultRepositoryTimeout
+}
+
+// withRepositoryTimeout returns a context that expires after the timeout of
+// repo, or ctx itself when there is none
+func withRepositoryTimeout(ctx context.Context, repo Repository) (context.Context, context.CancelFunc) {
+	timeout := repositoryTimeout(repo)
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	cause := &stopError{fmt.Sprintf("repository timeout of %s exceeded", timeout), context.DeadlineExceeded}
+	return context.WithTimeoutCause(ctx, timeout, cause)
+}
+
+// withRunDeadline returns a context that expires after the -timeout of a run,
+// or ctx itself when there is none
+func withRunDeadline(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	cause := &stopError{fmt.Sprintf("run deadline of %s exceeded", timeout), context.DeadlineExceeded}
+	return context.WithTimeoutCause(ctx, timeout, cause)
+}
+
+// notifyContext returns a context canceled on the first SIGINT or SIGTERM.
+// The signals are handled once, so that a second one kills the process.
+func notifyContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.Printf("Received %s, stopping (repeat to exit immediately)", sig)
+			cancel(&stopError{fmt.Sprintf("interrupted by %s", sig), context.Canceled})
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() { cancel(nil) }
+}
+
+// contextCategory returns the error category of a sync stopped by err, or ""
+// when err is not about a context
+func contextCategory(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return categoryCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errStalled):
+		return categoryTimeout
+	}
+	return ""
+}
+
+// watchStall calls stop when the progress reported by progress has not moved
+// for timeout, until ctx is done
+func watchStall(ctx context.Context, timeout time.Duration, progress func() int64, stop context.CancelCauseFunc) {
+	ticker := time.NewTicker(max(min(timeout/10, time.Second), 10*time.Millisecond))
+	defer ticker.Stop()
+
+	last, lastChange := progress(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if current := progress(); current != last {
+				last, lastChange = current, now
+			} else if now.Sub(lastChange) >= timeout {
+				stop(&stopError{fmt.Sprintf("stalled, no data received for %s", timeout), errStalled})
+				return
+			}
+		}
+	}
+}
+
+// countingWriter counts the bytes written to it, which can be read while
+// they are being written
+type countingWriter struct {
+	n atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// packSize returns the size of the pack directory of a bare repository, where
+// git writes the packs it receives
+func packSize(repoDir string) int64 {
+	entries, err := os.ReadDir(filepath.Join(repoDir, "objects", "pack"))
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveHangingGit returns the URL of a git HTTP server that never answers
+func serveHangingGit(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available, skipping integration tests")
+	}
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(done) })
+	return server.URL + "/test/hanging.git"
+}
+
+func withTimeouts(t *testing.T, stall, repository time.Duration) {
+	t.Helper()
+	savedStall, savedRepository := stallTimeout, defaultRepositoryTimeout
+	stallTimeout, defaultRepositoryTimeout = stall, repository
+	t.Cleanup(func() { stallTimeout, defaultRepositoryTimeout = savedStall, savedRepository })
+}
+
+func TestMirrorRepositoryStallDetector(t *testing.T) {
+	withTimeouts(t, 200*time.Millisecond, 0)
+	withRetryPolicy(t, retryPolicy{Retries: 3, Delay: time.Millisecond})
+	repo := Repository{Provider: "local", Owner: "test", Name: "hanging", URL: serveHangingGit(t)}
+
+	start := time.Now()
+	result := mirrorRepository(context.Background(), t.TempDir(), repo)
+	if result.Category != categoryTimeout || !errors.Is(result.Err, errStalled) || result.Attempts != 1 {
+		t.Errorf("mirrorRepository() = %+v, want a stalled timeout without retries", result)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("mirrorRepository() took %s to detect the stall", elapsed)
+	}
+}
+
+func TestMirrorRepositoryTimeout(t *testing.T) {
+	withTimeouts(t, 0, time.Hour)
+	repo := Repository{
+		Provider: "local", Owner: "test", Name: "hanging", URL: serveHangingGit(t),
+		Options: &RepositoryOptions{Timeout: 200 * time.Millisecond},
+	}
+
+	result := mirrorRepository(context.Background(), t.TempDir(), repo)
+	if result.Category != categoryTimeout || !errors.Is(result.Err, context.DeadlineExceeded) {
+		t.Errorf("mirrorRepository() = %+v, want a timeout", result)
+	}
+	if !strings.Contains(result.Err.Error(), "repository timeout of 200ms exceeded") {
+		t.Errorf("mirrorRepository() error = %v, want the repository timeout", result.Err)
+	}
+}
+
+func TestWorkerCancellation(t *testing.T) {
+	withTimeouts(t, 0, 0)
+	url := serveHangingGit(t)
+	repos := []Repository{
+		{Provider: "local", Owner: "test", Name: "first", URL: url},
+		{Provider: "local", Owner: "test", Name: "second", URL: url},
+		{Provider: "local", Owner: "test", Name: "third", URL: url},
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	repoChan := make(chan Repository, len(repos))
+	resultChan := make(chan Result, len(repos))
+	for _, repo := range repos {
+		repoChan <- repo
+	}
+	close(repoChan)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go worker(ctx, t.TempDir(), repoChan, resultChan, &wg)
+
+	// Interrupt the first clone, which hangs
+	time.Sleep(200 * time.Millisecond)
+	cancel(fmt.Errorf("interrupted by test: %w", context.Canceled))
+	wg.Wait()
+	close(resultChan)
+
+	var results []Result
+	for result := range resultChan {
+		results = append(results, result)
+	}
+	if len(results) != len(repos) {
+		t.Fatalf("worker() returned %d results, want %d", len(results), len(repos))
+	}
+	for _, result := range results {
+		if result.Succeeded() || result.Category != categoryCanceled {
+			t.Errorf("worker() result = %+v, want canceled", result)
+		}
+	}
+	if !strings.HasPrefix(results[1].Err.Error(), "Not synced") {
+		t.Errorf("worker() result of a pending repository = %v, want not synced", results[1].Err)
+	}
+}
+
+func TestStripProgress(t *testing.T) {
+	stderr := "Cloning into bare repository 'x.git'...\n" +
+		"remote: Enumerating objects: 5, done.\n" +
+		"remote: Counting objects:  20% (1/5)\rremote: Counting objects: 100% (5/5), done.\n" +
+		"Receiving objects:  40% (2/5)\rReceiving objects: 100% (5/5), done.\n" +
+		"remote: Total 5 (delta 0), reused 0 (delta 0), pack-reused 0\n" +
+		"fatal: early EOF\n"
+
+	expected := "Cloning into bare repository 'x.git'...\n" +
+		"remote: Total 5 (delta 0), reused 0 (delta 0), pack-reused 0\n" +
+		"fatal: early EOF"
+	if got := stripProgress(stderr); got != expected {
+		t.Errorf("stripProgress() = %q, want %q", got, expected)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// validationReport is the outcome of checking a registry without mirroring it
+type validationReport struct {
+	Entries  int               `json:"entries"`
+	Errors   int               `json:"errors"`
+	Warnings int               `json:"warnings"`
+	Problems []registryProblem `json:"problems"`
+}
+
+// validateRegistry reads the registry at filename and reports every problem
+// found instead of stopping at the first one. Duplicates are warnings unless
+// strict is set. With remote set, owner patterns are expanded through the
+// provider APIs, and each repository is also checked to be reachable with
+// git ls-remote.
+func validateRegistry(filename string, strict, remote bool) validationReport {
+	report := validationReport{Problems: []registryProblem{}}
+
+	// Without remote, nothing goes over the network, so that a rate limit or
+	// an offline machine is not reported as a registry problem
+	loader := &registryLoader{noExpand: !remote}
+	err := loader.load(filename)
+	report.Problems = append(report.Problems, loader.problems...)
+	if err != nil {
+		var problemErr *problemError
+		if errors.As(err, &problemErr) {
+			report.Problems = append(report.Problems, problemErr.registryProblem)
+		} else {
+			report.Problems = append(report.Problems, registryProblem{File: filename, Severity: severityError, Message: err.Error()})
+		}
+	}
+
+	entries, duplicates := dedupeRepositories(loader.repositories())
+	severity := severityWarning
+	if strict {
+		severity = severityError
+	}
+	for _, duplicate := range duplicates {
+		report.Problems = append(report.Problems, duplicate.problem(severity))
+	}
+
+	if remote && err == nil {
+		report.Problems = append(report.Problems, checkRemotes(entries)...)
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		a, b := report.Problems[i], report.Problems[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+
+	report.Entries = len(entries)
+	for _, problem := range report.Problems {
+		if problem.Severity == severityError {
+			report.Errors++
+		} else {
+			report.Warnings++
+		}
+	}
+	return report
+}
+
+// remoteCheckTimeout bounds the git ls-remote of each repository checked by
+// validate -remote
+var remoteCheckTimeout = 30 * time.Second
+
+// checkRemotes runs git ls-remote against every repository concurrently and
+// reports those that cannot be reached
+func checkRemotes(entries []sourcedRepository) []registryProblem {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		problems []registryProblem
+	)
+
+	entryChan := make(chan sourcedRepository)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range entryChan {
+				ctx, cancel := context.WithTimeout(context.Background(), remoteCheckTimeout)
+				cmd := gitCommand(ctx, entry.Repository, "ls-remote", "--heads", entry.URL)
+				// Never wait for a password, passphrase or host key prompt,
+				// nor for an unreachable host
+				killProcessGroup(cmd)
+				cmd.Env = nonInteractiveSSH(cmd.Environ())
+				stderr, err := runCommand(cmd)
+				cancel()
+				if err != nil {
+					message := lastLine(stderr)
+					if ctx.Err() != nil {
+						message = fmt.Sprintf("no answer within %s", remoteCheckTimeout)
+					} else if message == "" {
+						message = err.Error()
+					}
+
+					mu.Lock()
+					problems = append(problems, registryProblem{
+						File:     entry.File,
+						Line:     entry.Line,
+						Column:   entry.Column,
+						Severity: severityError,
+						Entry:    redactURL(entry.URL),
+						Message:  "remote check failed: " + message,
+					})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, entry := range entries {
+		entryChan <- entry
+	}
+	close(entryChan)
+	wg.Wait()
+
+	return problems
+}
+
+// nonInteractiveSSH makes the ssh command of git in env fail rather than
+// prompt, adding BatchMode to the command given by GIT_SSH_COMMAND, if any
+func nonInteractiveSSH(env []string) []string {
+	command := "ssh"
+	for _, variable := range env {
+		if value, found := strings.CutPrefix(variable, "GIT_SSH_COMMAND="); found && value != "" {
+			command = value
+		}
+	}
+	return append(env, "GIT_SSH_COMMAND="+command+" -o BatchMode=yes")
+}
+
+// writeValidationReport prints the report as "file:line:column" diagnostics
+// followed by a summary, or as a JSON document
+func writeValidationReport(w io.Writer, report validationReport, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+
+	for _, problem := range report.Problems {
+		if _, err := fmt.Fprintln(w, problem.diagnostic()); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d entries, %d errors, %d warnings\n", report.Entries, report.Errors, report.Warnings)
+	return err
+}
+
+// runValidate implements the validate command, which checks a registry and
+// exits with a non-zero status when it has errors
+func runValidate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	registryFile := flags.String("input", DefaultRegistryFile, "Path to the registry file or directory")
+	configFile := flags.String("config", DefaultConfigFile, "Path to the configuration file")
+	format := flags.String("format", "text", "Output format: text or json")
+	remote := flags.Bool("remote", false, "Check that every repository is reachable with git ls-remote")
+	strict := flags.Bool("strict", false, "Report entries sharing a mirror directory as errors")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s validate [flags]\n\n", AppName)
+		fmt.Fprintln(flags.Output(), "Checks the registry and reports every problem with its file, line and column.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		exitf(exitConfigError, "Failed to parse arguments: %v", err)
+	}
+	if flags.NArg() != 0 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		os.Exit(exitConfigError)
+	}
+
+	loadConfigFile(*configFile)
+
+	report := validateRegistry(expandPath(*registryFile), *strict, *remote)
+	if err := writeValidationReport(os.Stdout, report, *format); err != nil {
+		exitf(exitConfigError, "Failed to write report: %v", err)
+	}
+	if report.Errors > 0 {
+		os.Exit(exitRegistryError)
+	}
+}
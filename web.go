@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"html/template"
+	"log"
+	"net/http"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits of the web interface: the commits of a repository page, the tags
+// listed on it, and the largest file shown in the blob viewer
+const (
+	webCommits     = 20
+	webTags        = 100
+	webMaxBlobSize = 1 << 20
+)
+
+// webBinaryProbe is how far into a file the blob viewer looks for a NUL byte,
+// like git does to tell binary files apart
+const webBinaryProbe = 8000
+
+// webRepository is a mirror as listed by the web interface, with the outcome
+// of its last sync
+type webRepository struct {
+	Repository
+	// Path is the path of the mirror in the mirrors directory, which is
+	// also the path of its pages
+	Path     string
+	Mirrored bool
+	// LastSync is the time of the last successful sync, LastAttempt the
+	// time of the last sync whatever its result
+	LastSync    time.Time
+	LastAttempt time.Time
+	LastResult  string
+	LastError   string
+}
+
+type webOwner struct {
+	Name  string
+	Repos []webRepository
+}
+
+type webProvider struct {
+	Name   string
+	Owners []webOwner
+}
+
+// webRef is a branch or tag of a repository page
+type webRef struct {
+	Name   string
+	Commit string
+	Time   time.Time
+}
+
+type webCommit struct {
+	Hash    string
+	Author  string
+	Time    time.Time
+	Subject string
+}
+
+// webEntry is an entry of the tree viewer
+type webEntry struct {
+	Name string
+	Path string
+	// Kind is blob, tree, or commit for a submodule
+	Kind   string
+	Object string
+	Size   int64
+}
+
+// webCrumb is a parent directory in the path of a tree or blob page
+type webCrumb struct {
+	Name string
+	Path string
+}
+
+// webPage holds the data of all the pages of the web interface, each using
+// the fields it needs
+type webPage struct {
+	Title     string
+	Providers []webProvider
+
+	Repo     webRepository
+	CloneURL string
+	Size     int64
+	// Ref is the branch, tag or commit browsed, and Commit its hash
+	Ref           string
+	Commit        string
+	DefaultBranch string
+	Branches      []webRef
+	Tags          []webRef
+	Commits       []webCommit
+
+	Path    string
+	Crumbs  []webCrumb
+	Entries []webEntry
+
+	// Lines is the content of a text blob, which is left empty for a binary
+	// or too large one
+	Lines    []string
+	BlobSize int64
+	Binary   bool
+	TooLarge bool
+}
+
+// serveWeb answers the pages of the web interface: / lists the mirrors, and
+// /<mirror path> shows a mirror, with its files under /<mirror path>/-/tree,
+// /-/blob and /-/raw, given ref and path query parameters
+func (s *gitServer) serveWeb(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == "/" {
+		renderWebPage(w, "index", webPage{Title: AppName, Providers: s.webProviders()})
+		return
+	}
+
+	repoPath, view, _ := strings.Cut(strings.Trim(r.URL.Path, "/"), "/-/")
+	repo, ok := s.resolve(r.Host, repoPath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	ref, filePath := query.Get("ref"), strings.Trim(query.Get("path"), "/")
+	if !validWebPath(filePath) || (ref != "" && (!revisionQuery.MatchString(ref) || strings.Contains(ref, ".."))) {
+		http.NotFound(w, r)
+		return
+	}
+
+	lock, err := s.lock(r.Context(), repo)
+	if err != nil {
+		log.Printf("Warning: %s: %v", repoPath, err)
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "The mirror is being updated, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer lock.release()
+
+	page := webPage{Repo: s.webRepository(repo), Path: filePath, Crumbs: webCrumbs(filePath)}
+	page.Title = page.Repo.Path
+	repoDir := repositoryDir(s.mirrorsDir, repo)
+	ctx := r.Context()
+
+	page.DefaultBranch = defaultBranch(ctx, repoDir)
+	page.Ref = ref
+	if ref == "" {
+		page.Ref = page.DefaultBranch
+	}
+	if page.Ref != "" {
+		page.Commit = resolveCommit(ctx, repoDir, page.Ref)
+	}
+	// An empty mirror has no commit to browse, which only its own page shows
+	if page.Commit == "" && (view != "" || ref != "") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch view {
+	case "":
+		err = s.webRepositoryPage(ctx, r, &page, repoDir)
+		if err == nil {
+			renderWebPage(w, "repository", page)
+		}
+	case "tree":
+		var found bool
+		page.Entries, found, err = webTree(ctx, repoDir, page.Commit, filePath)
+		if err == nil && !found {
+			http.NotFound(w, r)
+			return
+		}
+		if err == nil {
+			page.Title += "/" + filePath
+			renderWebPage(w, "tree", page)
+		}
+	case "blob", "raw":
+		var entry webEntry
+		var found bool
+		entry, found, err = lookupWebEntry(ctx, repoDir, page.Commit, filePath)
+		if err == nil && (!found || entry.Kind != "blob") {
+			http.NotFound(w, r)
+			return
+		}
+		if err == nil && view == "raw" {
+			err = writeRawBlob(ctx, w, repoDir, entry)
+		} else if err == nil {
+			page.Title += "/" + filePath
+			err = readWebBlob(ctx, &page, repoDir, entry)
+			if err == nil {
+				renderWebPage(w, "blob", page)
+			}
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		// The error names paths of the server, which only its log shows
+		log.Printf("Warning: %s: %v", r.URL, err)
+		http.Error(w, "Failed to read the mirror", http.StatusInternalServerError)
+	}
+}
+
+// webProviders groups the mirrors of the registry by provider and owner, in
+// alphabetical order
+func (s *gitServer) webProviders() []webProvider {
+	repos := slices.Clone(s.exports.repos)
+	slices.SortFunc(repos, func(a, b Repository) int {
+		return strings.Compare(
+			strings.ToLower(a.Provider+"\x00"+a.Owner+"\x00"+a.Name),
+			strings.ToLower(b.Provider+"\x00"+b.Owner+"\x00"+b.Name))
+	})
+
+	var groups []webProvider
+	for _, repo := range repos {
+		if len(groups) == 0 || groups[len(groups)-1].Name != repo.Provider {
+			groups = append(groups, webProvider{Name: repo.Provider})
+		}
+		provider := &groups[len(groups)-1]
+		if len(provider.Owners) == 0 || provider.Owners[len(provider.Owners)-1].Name != repo.Owner {
+			provider.Owners = append(provider.Owners, webOwner{Name: repo.Owner})
+		}
+		owner := &provider.Owners[len(provider.Owners)-1]
+		owner.Repos = append(owner.Repos, s.webRepository(repo))
+	}
+	return groups
+}
+
+// webRepository reads the status of the mirror of repo from its config file,
+// without running git
+func (s *gitServer) webRepository(repo Repository) webRepository {
+	repoDir := repositoryDir(s.mirrorsDir, repo)
+	status := webRepository{Repository: repo, Mirrored: mirrorExists(repoDir)}
+	if rel, err := filepath.Rel(s.mirrorsDir, repoDir); err == nil {
+		status.Path = filepath.ToSlash(rel)
+	}
+
+	config := mirrorConfig(repoDir)
+	status.LastSync, _ = time.Parse(time.RFC3339, config[lastSyncKey])
+	status.LastAttempt, _ = time.Parse(time.RFC3339, config[lastAttemptKey])
+	status.LastResult = config[lastResultKey]
+	status.LastError = config[lastErrorKey]
+	// Mirrors synced before results were recorded only have their last
+	// successful sync
+	if status.LastAttempt.IsZero() {
+		status.LastAttempt = status.LastSync
+	}
+	return status
+}
+
+// webRepositoryPage fills the summary of a mirror: its size, clone URL,
+// branches, tags, and the recent commits and files of the browsed ref
+func (s *gitServer) webRepositoryPage(ctx context.Context, r *http.Request, page *webPage, repoDir string) error {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	page.CloneURL = scheme + "://" + r.Host + "/" + page.Repo.Path + ".git"
+	page.Size = objectsSize(repoDir)
+
+	var err error
+	if page.Branches, err = listRefs(ctx, repoDir, "refs/heads/", "-committerdate", 0); err != nil {
+		return err
+	}
+	if page.Tags, err = listRefs(ctx, repoDir, "refs/tags/", "-creatordate", webTags); err != nil {
+		return err
+	}
+	if page.Commit == "" {
+		return nil
+	}
+	if page.Commits, err = recentCommits(ctx, repoDir, page.Commit, webCommits); err != nil {
+		return err
+	}
+	page.Entries, _, err = webTree(ctx, repoDir, page.Commit, "")
+	return err
+}
+
+// defaultBranch returns the branch HEAD points to in a mirror, or "" when
+// it is detached or broken
+func defaultBranch(ctx context.Context, repoDir string) string {
+	output, err := readGit(ctx, repoDir, "symbolic-ref", "--quiet", "--short", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// resolveCommit returns the hash of the commit of a revision, or "" when the
+// revision does not exist
+func resolveCommit(ctx context.Context, repoDir, rev string) string {
+	output, err := readGit(ctx, repoDir, "log", "-1", "--format=%H", "--end-of-options", rev, "--")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// listRefs lists the refs under prefix, sorted by key, keeping the first
+// count of them unless it is 0
+func listRefs(ctx context.Context, repoDir, prefix, sort string, count int) ([]webRef, error) {
+	args := []string{"for-each-ref", "--sort=" + sort, "--format=%(refname)%00%(objectname)%00%(*objectname)%00%(creatordate:unix)"}
+	if count > 0 {
+		args = append(args, "--count="+strconv.Itoa(count))
+	}
+	output, err := readGit(ctx, repoDir, append(args, prefix)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []webRef
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\x00")
+		if len(fields) != 4 {
+			continue
+		}
+		ref := webRef{Name: strings.TrimPrefix(fields[0], prefix), Commit: fields[1]}
+		// Annotated tags point to their tag object rather than the commit
+		if fields[2] != "" {
+			ref.Commit = fields[2]
+		}
+		if seconds, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
+			ref.Time = time.Unix(seconds, 0).UTC()
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// recentCommits returns the last count commits of the history of commit
+func recentCommits(ctx context.Context, repoDir, commit string, count int) ([]webCommit, error) {
+	output, err := readGit(ctx, repoDir, "log", "-n", strconv.Itoa(count), "--format=%H%x00%an%x00%ct%x00%s", commit, "--")
+	if err != nil {
+		return nil, err
+	}
+
+	var commits []webCommit
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.SplitN(line, "\x00", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		seconds, _ := strconv.ParseInt(fields[2], 10, 64)
+		commits = append(commits, webCommit{
+			Hash:    fields[0],
+			Author:  fields[1],
+			Time:    time.Unix(seconds, 0).UTC(),
+			Subject: fields[3],
+		})
+	}
+	return commits, nil
+}
+
+// webTree lists the directory at dir in the tree of commit, directories
+// first, reporting whether it exists
+func webTree(ctx context.Context, repoDir, commit, dir string) ([]webEntry, bool, error) {
+	tree := commit
+	if dir != "" {
+		entry, found, err := lookupWebEntry(ctx, repoDir, commit, dir)
+		if err != nil || !found || entry.Kind != "tree" {
+			return nil, false, err
+		}
+		tree = entry.Object
+	}
+	files, err := listTree(ctx, repoDir, tree, false)
+	if err != nil {
+		return nil, false, err
+	}
+
+	entries := make([]webEntry, 0, len(files))
+	for _, file := range files {
+		entries = append(entries, webEntry{
+			Name:   file.path,
+			Path:   path.Join(dir, file.path),
+			Kind:   file.kind,
+			Object: file.object,
+			Size:   file.size,
+		})
+	}
+	slices.SortStableFunc(entries, func(a, b webEntry) int {
+		if (a.Kind == "tree") != (b.Kind == "tree") {
+			if a.Kind == "tree" {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	})
+	return entries, true, nil
+}
+
+// lookupWebEntry finds the entry at filePath in the tree of commit, through
+// a listing of its parent directory
+func lookupWebEntry(ctx context.Context, repoDir, commit, filePath string) (webEntry, bool, error) {
+	if filePath == "" {
+		return webEntry{}, false, nil
+	}
+	parent, name := path.Split(filePath)
+	entries, found, err := webTree(ctx, repoDir, commit, strings.TrimSuffix(parent, "/"))
+	if err != nil || !found {
+		return webEntry{}, false, err
+	}
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry, true, nil
+		}
+	}
+	return webEntry{}, false, nil
+}
+
+// readWebBlob loads a blob into the lines of page, unless it is binary or
+// too large to show
+func readWebBlob(ctx context.Context, page *webPage, repoDir string, entry webEntry) error {
+	page.BlobSize = entry.Size
+	if entry.Size > webMaxBlobSize {
+		page.TooLarge = true
+		return nil
+	}
+	content, err := readGit(ctx, repoDir, "cat-file", "blob", entry.Object)
+	if err != nil {
+		return err
+	}
+	if bytes.IndexByte(content[:min(len(content), webBinaryProbe)], 0) >= 0 {
+		page.Binary = true
+		return nil
+	}
+	if len(content) > 0 {
+		page.Lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	}
+	return nil
+}
+
+// writeRawBlob sends the content of a blob as plain text, so that browsers
+// never render files of the mirrors as pages of the server
+func writeRawBlob(ctx context.Context, w http.ResponseWriter, repoDir string, entry webEntry) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+	cmd := exec.CommandContext(ctx, "git", "-C", repoDir, "cat-file", "blob", entry.Object)
+	cmd.Stdout = w
+	if stderr, err := runCommand(cmd); err != nil {
+		// The response has started, so the error can only be logged
+		log.Printf("Warning: cat-file of %s in %s failed: %v: %s", entry.Object, repoDir, err, lastLine(stderr))
+	}
+	return nil
+}
+
+// validWebPath reports whether a path within a repository is made of plain
+// names, "" standing for the root
+func validWebPath(filePath string) bool {
+	if filePath == "" {
+		return true
+	}
+	for _, segment := range strings.Split(filePath, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// webCrumbs returns the directories leading to filePath, itself included
+func webCrumbs(filePath string) []webCrumb {
+	if filePath == "" {
+		return nil
+	}
+	var crumbs []webCrumb
+	segments := strings.Split(filePath, "/")
+	for i, segment := range segments {
+		crumbs = append(crumbs, webCrumb{Name: segment, Path: strings.Join(segments[:i+1], "/")})
+	}
+	return crumbs
+}
+
+// renderWebPage renders a page into a buffer first, so that a template error
+// still gets a proper error response
+func renderWebPage(w http.ResponseWriter, name string, page webPage) {
+	var b bytes.Buffer
+	if err := webTemplates.ExecuteTemplate(&b, name, page); err != nil {
+		log.Printf("Warning: failed to render the %s page: %v", name, err)
+		http.Error(w, "Failed to render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setNoCache(w)
+	_, _ = w.Write(b.Bytes())
+}
+
+var webTemplates = template.Must(template.New("web").Funcs(template.FuncMap{
+	"appName":   func() string { return AppName },
+	"bytes":     formatBytes,
+	"redactURL": redactURL,
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return t.UTC().Format("2006-01-02 15:04 UTC")
+	},
+	"short": func(hash string) string {
+		return hash[:min(len(hash), 12)]
+	},
+	"inc": func(i int) int { return i + 1 },
+}).Parse(webTemplateText))
+
+const webTemplateText = `
+{{define "header"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0 auto; max-width: 72rem; padding: 1rem 2rem; color: #222; }
+a { color: #0550ae; text-decoration: none; }
+a:hover { text-decoration: underline; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5rem; }
+th, td { text-align: left; padding: 0.25rem 0.75rem 0.25rem 0; border-bottom: 1px solid #eee; vertical-align: top; }
+code, pre, .mono { font-family: ui-monospace, monospace; font-size: 0.9rem; }
+.muted { color: #777; }
+.failed { color: #b00; }
+.blob td { border: none; padding: 0 0.75rem 0 0; white-space: pre; }
+.blob td.line { text-align: right; color: #999; user-select: none; }
+</style>
+</head>
+<body>
+<p><a href="/">{{appName}}</a></p>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "status"}}{{if not .Mirrored}}<span class="muted">not mirrored yet</span>{{else if eq .LastResult "failed"}}<span class="failed" title="{{.LastError}}">failed {{time .LastAttempt}}</span>{{else if .LastResult}}{{.LastResult}} {{time .LastAttempt}}{{else}}{{time .LastSync}}{{end}}{{end}}
+
+{{define "index"}}{{template "header" .}}
+<h1>Mirrors</h1>
+{{range .Providers}}
+<h2 id="{{.Name}}">{{.Name}}</h2>
+{{range .Owners}}
+<h3>{{.Name}}</h3>
+<table>
+<tr><th>Repository</th><th>Last sync</th><th>Last result</th></tr>
+{{range .Repos}}<tr>
+<td>{{if .Mirrored}}<a href="/{{.Path}}">{{.Name}}</a>{{else}}{{.Name}}{{end}}</td>
+<td>{{time .LastSync}}</td>
+<td>{{template "status" .}}</td>
+</tr>
+{{end}}</table>
+{{end}}
+{{else}}<p class="muted">No mirrors in the registry.</p>
+{{end}}
+{{template "footer"}}{{end}}
+
+{{define "repository"}}{{template "header" .}}
+<h1>{{.Repo.Provider}} / {{.Repo.Owner}} / {{.Repo.Name}}</h1>
+<table>
+<tr><th>Clone</th><td><code>git clone {{.CloneURL}}</code></td></tr>
+<tr><th>Upstream</th><td><code>{{redactURL .Repo.URL}}</code></td></tr>
+<tr><th>Last sync</th><td>{{time .Repo.LastSync}}</td></tr>
+<tr><th>Last result</th><td>{{template "status" .Repo}}{{if .Repo.LastError}}<br><span class="failed mono">{{.Repo.LastError}}</span>{{end}}</td></tr>
+<tr><th>Size on disk</th><td>{{bytes .Size}}</td></tr>
+</table>
+{{if .Commit}}
+<h2>Files of {{.Ref}}</h2>
+{{template "entries" .}}
+<h2>Recent commits of {{.Ref}}</h2>
+<table>
+{{range .Commits}}<tr>
+<td class="mono"><a href="/{{$.Repo.Path}}/-/tree?ref={{.Hash}}">{{short .Hash}}</a></td>
+<td>{{.Subject}}</td>
+<td class="muted">{{.Author}}</td>
+<td class="muted">{{time .Time}}</td>
+</tr>
+{{end}}</table>
+{{else}}<p class="muted">This mirror has no commits.</p>
+{{end}}
+<h2>Branches</h2>
+<table>
+{{range .Branches}}<tr>
+<td><a href="/{{$.Repo.Path}}?ref={{.Name}}">{{.Name}}</a>{{if eq .Name $.DefaultBranch}} <span class="muted">default</span>{{end}}</td>
+<td class="mono">{{short .Commit}}</td>
+<td class="muted">{{time .Time}}</td>
+</tr>
+{{else}}<tr><td class="muted">No branches</td></tr>
+{{end}}</table>
+<h2>Tags</h2>
+<table>
+{{range .Tags}}<tr>
+<td><a href="/{{$.Repo.Path}}?ref={{.Name}}">{{.Name}}</a></td>
+<td class="mono">{{short .Commit}}</td>
+<td class="muted">{{time .Time}}</td>
+</tr>
+{{else}}<tr><td class="muted">No tags</td></tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+
+{{define "crumbs"}}<h1><a href="/{{.Repo.Path}}?ref={{.Ref}}">{{.Repo.Path}}</a>{{range .Crumbs}} / <a href="/{{$.Repo.Path}}/-/tree?ref={{$.Ref}}&amp;path={{.Path}}">{{.Name}}</a>{{end}}</h1>
+<p class="muted">at {{.Ref}} <span class="mono">{{short .Commit}}</span></p>
+{{end}}
+
+{{define "entries"}}<table>
+{{range .Entries}}<tr>
+<td class="mono">{{if eq .Kind "tree"}}<a href="/{{$.Repo.Path}}/-/tree?ref={{$.Ref}}&amp;path={{.Path}}">{{.Name}}/</a>{{else if eq .Kind "blob"}}<a href="/{{$.Repo.Path}}/-/blob?ref={{$.Ref}}&amp;path={{.Path}}">{{.Name}}</a>{{else}}{{.Name}} <span class="muted">@ {{short .Object}}</span>{{end}}</td>
+<td class="muted">{{if eq .Kind "blob"}}{{bytes .Size}}{{end}}</td>
+</tr>
+{{else}}<tr><td class="muted">Empty directory</td></tr>
+{{end}}</table>
+{{end}}
+
+{{define "tree"}}{{template "header" .}}
+{{template "crumbs" .}}
+{{template "entries" .}}
+{{template "footer"}}{{end}}
+
+{{define "blob"}}{{template "header" .}}
+{{template "crumbs" .}}
+<p class="muted">{{bytes .BlobSize}} · <a href="/{{.Repo.Path}}/-/raw?ref={{.Ref}}&amp;path={{.Path}}">raw</a></p>
+{{if .TooLarge}}<p class="muted">This file is too large to show.</p>
+{{else if .Binary}}<p class="muted">This file is binary.</p>
+{{else}}<table class="blob">
+{{range $i, $line := .Lines}}<tr id="L{{inc $i}}"><td class="line mono"><a href="#L{{inc $i}}">{{inc $i}}</a></td><td class="mono">{{$line}}</td></tr>
+{{end}}</table>
+{{end}}
+{{template "footer"}}{{end}}
+`